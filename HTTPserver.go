@@ -2,9 +2,12 @@ package dht
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+
+	"dht/util"
 )
 
 // para: UPD host&port and TCP host&port
@@ -25,8 +28,13 @@ func (d *DHT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		w.Header().Add("Content-Type", "application/json")
-		// TODO
-		// PARA
+		var regs []Registration
+		for _, n := range d.HonestPeers() {
+			regs = append(regs, Registration{NodeAddr: n.Address, Nodeid: n.ID.String()})
+		}
+		if err := json.NewEncoder(w).Encode(regs); err != nil {
+			d.DebugLogger.Errorf("error writing honest peers:%v", err)
+		}
 	case http.MethodPost:
 		dec := json.NewDecoder(r.Body)
 		var r Registration
@@ -36,17 +44,51 @@ func (d *DHT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		log.Println(r)
-		err = d.ADDHonestPeer(r.Nodeid, r.NodeAddr)
+		d.DebugLogger.Debugf("add node post: %+v", r)
+		id, err := decodeNodeID(r.Nodeid)
 		if err != nil {
 			d.DebugLogger.Errorf("error parsing add node post:%v", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-	// TODO
-	// case http.MethodDelete:
+		err = d.ADDHonestPeer(id, r.NodeAddr)
+		if err != nil {
+			d.DebugLogger.Errorf("error parsing add node post:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		dec := json.NewDecoder(r.Body)
+		var r Registration
+		err := dec.Decode(&r)
+		if err != nil {
+			d.DebugLogger.Errorf("error parsing remove node request:%v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = d.RemoveHonestPeer(r.NodeAddr)
+		if err != nil {
+			d.DebugLogger.Errorf("error removing node:%v", err)
+			if errors.Is(err, ErrNotTrusted) {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				// The address couldn't be resolved.
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 }
+
+// decodeNodeID accepts a node ID either hex encoded, as listed by GET, or as
+// the raw 20 bytes. An empty ID is kept empty.
+func decodeNodeID(s string) (string, error) {
+	if s == "" || len(s) == 20 {
+		return s, nil
+	}
+	id, err := util.DecodeInfoHash(s)
+	return string(id), err
+}
@@ -6,7 +6,7 @@ type Registration struct {
 	InfoHash []string
 	// DHT Node UPDAddr: IP and Port
 	NodeAddr string
-	// DHT Node ID
+	// DHT Node ID, hex encoded. POST also accepts the raw 20 bytes.
 	Nodeid string
 	// DHT node runs a http server on this URL
 	// if method POST: accept peer info update
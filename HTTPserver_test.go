@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPHonestPeers(t *testing.T) {
+	d := newTestDHT(t, nil)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	serve := func(method string, reg interface{}) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if reg != nil {
+			json.NewEncoder(&body).Encode(reg)
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest(method, "/update", &body))
+		return w
+	}
+	if w := serve(http.MethodPost, Registration{NodeAddr: "10.0.0.1:1234", Nodeid: "d1c5676ae7ac98e8b19f63565905105e3c4c37a2"}); w.Code != http.StatusOK {
+		t.Fatalf("POST returned %d", w.Code)
+	}
+	if w := serve(http.MethodPost, Registration{NodeAddr: "10.0.0.3:1234", Nodeid: "01abcdefghij01234567"}); w.Code != http.StatusOK {
+		t.Errorf("POST with a raw ID returned %d", w.Code)
+	}
+	if w := serve(http.MethodPost, Registration{NodeAddr: "10.0.0.2:1234", Nodeid: "not hex"}); w.Code != http.StatusBadRequest {
+		t.Errorf("POST with an invalid ID returned %d, wanted %d", w.Code, http.StatusBadRequest)
+	}
+
+	// The IDs listed can be posted back.
+	var regs []Registration
+	if err := json.NewDecoder(serve(http.MethodGet, nil).Body).Decode(&regs); err != nil {
+		t.Fatalf("decoding GET reply: %v", err)
+	}
+	if len(regs) != 2 {
+		t.Fatalf("GET returned %+v", regs)
+	}
+	for _, reg := range regs {
+		want := map[string]string{
+			"10.0.0.1:1234": "d1c5676ae7ac98e8b19f63565905105e3c4c37a2",
+			"10.0.0.3:1234": "30316162636465666768696a3031323334353637",
+		}[reg.NodeAddr]
+		if reg.Nodeid != want {
+			t.Errorf("GET listed %v with ID %q, wanted %q", reg.NodeAddr, reg.Nodeid, want)
+		}
+		if w := serve(http.MethodPost, reg); w.Code != http.StatusOK {
+			t.Errorf("POST of a listed node returned %d", w.Code)
+		}
+	}
+
+	if w := serve(http.MethodDelete, Registration{NodeAddr: "10.0.0.1:1234"}); w.Code != http.StatusOK {
+		t.Errorf("DELETE returned %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, Registration{NodeAddr: "10.0.0.1:1234"}); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a removed node returned %d, wanted %d", w.Code, http.StatusNotFound)
+	}
+	if w := serve(http.MethodDelete, Registration{NodeAddr: "no port"}); w.Code != http.StatusBadRequest {
+		t.Errorf("DELETE of an invalid address returned %d, wanted %d", w.Code, http.StatusBadRequest)
+	}
+}
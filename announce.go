@@ -0,0 +1,260 @@
+package dht
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// The infohashes we are downloading are announced when PeersRequest adds them,
+// and again every AnnouncePeriod, so that remote peer stores don't expire us.
+// Each announce starts with a get_peers lookup that follows the closer nodes
+// found in the replies, and collects the tokens they return. Once the lookup
+// converges, or AnnounceLookupTime is over, announce_peer is sent to the
+// util.KNodes closest nodes that returned a token, and to no one else.
+
+// AnnounceStatus reports the scheduled announces of an infohash.
+type AnnounceStatus struct {
+	// Port announced.
+	Port int
+	// When the last announce was sent, zero if there was none yet.
+	LastAnnounce time.Time
+	// Number of nodes the last announce was sent to.
+	Nodes int
+	// Why the last announce failed, empty if it succeeded.
+	Err string
+	// When the next lookup is due. Zero while a lookup is running, or if
+	// none is scheduled.
+	NextAnnounce time.Time
+	// Outcome of the last announce for each node it was sent to, closest
+	// to the infohash first.
+	Report []NodeAnnounce
+}
+
+// NodeAnnounce is the outcome of an announce_peer sent to a node.
+type NodeAnnounce struct {
+	ID      util.InfoHash
+	Address string
+	// Set once the node acknowledged the announce.
+	OK bool
+	// Why the announce failed, empty if it succeeded or is still pending.
+	Err string
+}
+
+type announceState struct {
+	status AnnounceStatus
+	// When the next lookup is due, zero if none is scheduled.
+	next time.Time
+	// Set while a lookup is running.
+	lookup *announceLookup
+}
+
+type announceLookup struct {
+	started time.Time
+	// Addresses of the nodes already queried.
+	queried map[string]bool
+	// IDs of the queried nodes that didn't reply yet, by address.
+	pending map[string]string
+	// Nodes that replied with a token, by address.
+	responders map[string]announceResponder
+}
+
+type announceResponder struct {
+	id    string
+	addr  net.UDPAddr
+	token string
+}
+
+// closest returns up to util.KNodes responders, closest to ih first.
+func (l *announceLookup) closest(ih util.InfoHash) []announceResponder {
+	found := make([]announceResponder, 0, len(l.responders))
+	for _, r := range l.responders {
+		if len(r.id) == len(ih) {
+			found = append(found, r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return util.HashDistance(ih, util.InfoHash(found[i].id)) < util.HashDistance(ih, util.InfoHash(found[j].id))
+	})
+	if len(found) > util.KNodes {
+		found = found[:util.KNodes]
+	}
+	return found
+}
+
+// converged reports whether the lookup is over: no query is pending for a
+// node that could be among the util.KNodes closest responders.
+func (l *announceLookup) converged(ih util.InfoHash) bool {
+	closest := l.closest(ih)
+	for _, id := range l.pending {
+		if len(closest) < util.KNodes || len(id) != len(ih) ||
+			util.HashDistance(ih, util.InfoHash(id)) < util.HashDistance(ih, util.InfoHash(closest[len(closest)-1].id)) {
+			return false
+		}
+	}
+	return true
+}
+
+// announceTick starts the lookups that are due, announces the infohashes
+// whose lookups ran out of time, and fails the announces that were not
+// acknowledged in time.
+func (d *DHT) announceTick(now time.Time) {
+	downloads := d.peerStore.LocalDownloads()
+	for ih := range d.announces {
+		if _, ok := downloads[ih]; !ok {
+			delete(d.announces, ih)
+		}
+	}
+	for ih, port := range downloads {
+		s, ok := d.announces[ih]
+		if !ok {
+			// Downloads resumed from disk are announced right away.
+			s = &announceState{next: now}
+			d.announces[ih] = s
+		}
+		s.status.Port = port
+		if now.Sub(s.status.LastAnnounce) >= d.config.AnnounceLookupTime {
+			for i := range s.status.Report {
+				if r := &s.status.Report[i]; !r.OK && r.Err == "" {
+					r.Err = "no reply"
+				}
+			}
+		}
+		switch {
+		case s.lookup != nil && now.Sub(s.lookup.started) >= d.lookupDeadline(ih):
+			d.finishAnnounce(ih, s, now)
+		case s.lookup == nil && !s.next.IsZero() && !now.Before(s.next):
+			d.startAnnounce(ih, now)
+		}
+	}
+}
+
+// startAnnounce starts a lookup of ih that ends with an announce, unless one
+// is already running. Unlike getPeers, it doesn't skip the nodes contacted
+// recently, because fresh tokens are needed.
+func (d *DHT) startAnnounce(ih util.InfoHash, now time.Time) {
+	s, ok := d.announces[ih]
+	if !ok {
+		s = &announceState{}
+		d.announces[ih] = s
+	}
+	if s.lookup != nil {
+		return
+	}
+	s.lookup = &announceLookup{
+		started:    now,
+		queried:    make(map[string]bool),
+		pending:    make(map[string]string),
+		responders: make(map[string]announceResponder),
+	}
+	s.next = time.Time{}
+	s.status.NextAnnounce = time.Time{}
+	totalAnnounceLookups.Add(1)
+	closest := d.routingTable.Lookup(ih)
+	if len(closest) == 0 {
+		d.getPeers(ih)
+		return
+	}
+	d.routingTable.Touch(string(ih))
+	for _, r := range closest {
+		d.getPeersFrom(r, ih)
+	}
+}
+
+// finishAnnounce sends announce_peer to the closest nodes found by the
+// lookup of ih, and schedules the next one.
+func (d *DHT) finishAnnounce(ih util.InfoHash, s *announceState, now time.Time) {
+	closest := s.lookup.closest(ih)
+	s.lookup = nil
+	options := d.searchOptions(ih)
+	options.Port = d.peerStore.HasLocalDownload(ih)
+	s.status.Port = options.Port
+	s.status.Report = make([]NodeAnnounce, 0, len(closest))
+	for _, r := range closest {
+		d.announcePeer(r.addr, ih, options, r.token)
+		s.status.Report = append(s.status.Report, NodeAnnounce{ID: util.InfoHash(r.id), Address: r.addr.String()})
+	}
+	s.status.Nodes = len(closest)
+	s.status.Err = ""
+	if len(closest) == 0 {
+		s.status.Err = "no node returned a token"
+		totalFailedAnnounces.Add(1)
+	} else {
+		s.status.LastAnnounce = now
+	}
+	if d.config.AnnouncePeriod > 0 {
+		s.next = now.Add(jitter(d.config.AnnouncePeriod))
+	}
+	s.status.NextAnnounce = s.next
+}
+
+// lookupDeadline returns the maximum time the announce lookup of ih runs.
+func (d *DHT) lookupDeadline(ih util.InfoHash) time.Duration {
+	if deadline := d.searchOptions(ih).LookupDeadline; deadline > 0 {
+		return deadline
+	}
+	return d.config.AnnounceLookupTime
+}
+
+// announceReplied records that the node at addr acknowledged our announce of
+// ih.
+func (d *DHT) announceReplied(ih util.InfoHash, addr string) {
+	s, ok := d.announces[ih]
+	if !ok {
+		return
+	}
+	for i := range s.status.Report {
+		if r := &s.status.Report[i]; r.Address == addr {
+			r.OK = true
+			r.Err = ""
+		}
+	}
+}
+
+// announceLookup returns the running lookup for ih, or nil.
+func (d *DHT) announceLookup(ih util.InfoHash) *announceLookup {
+	if s, ok := d.announces[ih]; ok {
+		return s.lookup
+	}
+	return nil
+}
+
+// followLookup queries n about ih if it was not queried yet, and it may be
+// among the closest nodes found so far.
+func (d *DHT) followLookup(l *announceLookup, ih util.InfoHash, n *remoteNode.RemoteNode) {
+	if l.queried[n.Address.String()] || len(n.ID) != len(ih) {
+		return
+	}
+	if closest := l.closest(ih); len(closest) >= util.KNodes &&
+		util.HashDistance(ih, util.InfoHash(n.ID)) >= util.HashDistance(ih, util.InfoHash(closest[len(closest)-1].id)) {
+		return
+	}
+	d.getPeersFrom(n, ih)
+}
+
+// jitter returns period shortened by a random amount of up to a fifth, so
+// that the announces of different infohashes and nodes don't synchronize.
+func jitter(period time.Duration) time.Duration {
+	if period < 5 {
+		return period
+	}
+	return period - time.Duration(rand.Int63n(int64(period/5)))
+}
+
+// AnnounceStatus returns the status of the scheduled announces of each
+// infohash we are downloading. It is safe to call from any goroutine.
+func (d *DHT) AnnounceStatus() map[util.InfoHash]AnnounceStatus {
+	status := make(map[util.InfoHash]AnnounceStatus)
+	d.do(func() {
+		for ih, s := range d.announces {
+			st := s.status
+			st.Report = append([]NodeAnnounce(nil), s.status.Report...)
+			status[ih] = st
+		}
+	})
+	return status
+}
@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"expvar"
+	"net"
+	"time"
+
+	"dht/util"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Reasons for rejecting an announce_peer with a valid token, used as keys of
+// the rejectedAnnounces expvar.
+const (
+	// The port is below 1024, and RejectPrivilegedPorts is set.
+	rejectPort = "port"
+	// The source exceeded MaxAnnouncesPerInfoHash.
+	rejectPerInfoHash = "perInfoHash"
+	// The source exceeded MaxInfoHashesPerSource.
+	rejectInfoHashes = "infoHashes"
+)
+
+var rejectedAnnounces = expvar.NewMap("rejectedAnnounces")
+
+// announceLimiter counts the announces of each source IP during a window
+// that starts with its first announce, to keep a single host from filling
+// the peer store.
+type announceLimiter struct {
+	window      time.Duration
+	perInfoHash int
+	infoHashes  int
+	// Keyed by IP, values are *announceSource.
+	sources *lru.Cache
+}
+
+type announceSource struct {
+	start time.Time
+	// Number of announces for each infohash.
+	counts map[util.InfoHash]int
+}
+
+func newAnnounceLimiter(window time.Duration, perInfoHash, infoHashes int, maxSources int64) *announceLimiter {
+	if maxSources <= 0 {
+		maxSources = 1000
+	}
+	return &announceLimiter{
+		window:      window,
+		perInfoHash: perInfoHash,
+		infoHashes:  infoHashes,
+		sources:     lru.New(int(maxSources)),
+	}
+}
+
+// check records an announce of ih from ip, and returns the reason to reject
+// it, or "" if it's within the limits. Rejected announces are not counted.
+func (l *announceLimiter) check(ip net.IP, ih util.InfoHash, now time.Time) string {
+	if l.perInfoHash <= 0 && l.infoHashes <= 0 {
+		return ""
+	}
+	var s *announceSource
+	if v, ok := l.sources.Get(ip.String()); ok {
+		s = v.(*announceSource)
+	}
+	if s == nil || now.Sub(s.start) >= l.window {
+		s = &announceSource{start: now, counts: make(map[util.InfoHash]int)}
+		l.sources.Add(ip.String(), s)
+	}
+	n, known := s.counts[ih]
+	if l.perInfoHash > 0 && n >= l.perInfoHash {
+		return rejectPerInfoHash
+	}
+	if l.infoHashes > 0 && !known && len(s.counts) >= l.infoHashes {
+		return rejectInfoHashes
+	}
+	s.counts[ih] = n + 1
+	return ""
+}
+
+// announceRejection returns the reason to reject an announce of ih for port
+// from ip, or "" if it should be stored, and counts the rejections.
+func (d *DHT) announceRejection(ip net.IP, ih util.InfoHash, port int) string {
+	var reason string
+	if d.config.RejectPrivilegedPorts && port < 1024 {
+		reason = rejectPort
+	} else {
+		reason = d.announceLimits.check(ip, ih, time.Now())
+	}
+	if reason != "" {
+		rejectedAnnounces.Add(reason, 1)
+	}
+	return reason
+}
@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+func TestAnnounceLimiter(t *testing.T) {
+	l := newAnnounceLimiter(time.Minute, 2, 3, 10)
+	ip := net.IPv4(1, 2, 3, 4)
+	ih := util.InfoHash("aaaaaaaaaaaaaaaaaaaa")
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if reason := l.check(ip, ih, now); reason != "" {
+			t.Fatalf("announce %d rejected: %v", i, reason)
+		}
+	}
+	if reason := l.check(ip, ih, now); reason != rejectPerInfoHash {
+		t.Fatalf("third announce of the same infohash got %q, wanted %q", reason, rejectPerInfoHash)
+	}
+	// Other sources have their own limits.
+	if reason := l.check(net.IPv4(1, 2, 3, 5), ih, now); reason != "" {
+		t.Fatalf("announce from another IP rejected: %v", reason)
+	}
+
+	for i := 0; i < 2; i++ {
+		if reason := l.check(ip, util.InfoHash(fmt.Sprintf("%020d", i)), now); reason != "" {
+			t.Fatalf("announce of infohash %d rejected: %v", i, reason)
+		}
+	}
+	if reason := l.check(ip, util.InfoHash(fmt.Sprintf("%020d", 2)), now); reason != rejectInfoHashes {
+		t.Fatalf("fourth infohash got %q, wanted %q", reason, rejectInfoHashes)
+	}
+
+	// The counts start over with the next window.
+	if reason := l.check(ip, ih, now.Add(time.Minute)); reason != "" {
+		t.Fatalf("announce in the next window rejected: %v", reason)
+	}
+}
+
+func TestAnnounceRejection(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.RejectPrivilegedPorts = true })
+	ih := util.InfoHash("aaaaaaaaaaaaaaaaaaaa")
+	rejections := func() int64 {
+		if v, ok := rejectedAnnounces.Get(rejectPort).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := rejections()
+	for _, port := range []int{0, 80} {
+		if reason := d.announceRejection(net.IPv4(1, 2, 3, 4), ih, port); reason != rejectPort {
+			t.Errorf("announce of port %d got %q, wanted %q", port, reason, rejectPort)
+		}
+	}
+	if n := rejections() - before; n != 2 {
+		t.Errorf("counted %d rejections, wanted 2", n)
+	}
+	if reason := d.announceRejection(net.IPv4(1, 2, 3, 4), ih, 6881); reason != "" {
+		t.Errorf("announce of port 6881 rejected: %v", reason)
+	}
+}
+
+func TestImpliedPort(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.RejectPrivilegedPorts = true })
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	addr := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	var node *remoteNode.RemoteNode
+	var err error
+	d.do(func() { node, err = d.getOrCreateNode(randNodeID(t), addr.String(), remoteNode.SourceAdded) })
+	if err != nil {
+		t.Fatalf("getOrCreateNode: %v", err)
+	}
+	for _, test := range []struct {
+		ih          util.InfoHash
+		impliedPort int
+		peers       int
+	}{
+		// Port 80 is privileged.
+		{util.InfoHash("aaaaaaaaaaaaaaaaaaaa"), 0, 0},
+		// The source port of the query is announced instead.
+		{util.InfoHash("bbbbbbbbbbbbbbbbbbbb"), 1, 1},
+	} {
+		d.do(func() {
+			d.replyAnnouncePeer(addr, node, remoteNode.ResponseType{
+				T: "aa",
+				Y: "q",
+				Q: "announce_peer",
+				A: remoteNode.AnswerType{
+					Id:          node.ID,
+					InfoHash:    test.ih,
+					Port:        80,
+					ImpliedPort: test.impliedPort,
+					Token:       d.tokens.Token(addr, test.ih),
+				},
+			})
+		})
+		if n := d.peerStore.Count(test.ih); n != test.peers {
+			t.Errorf("implied_port %d: stored %d peers, wanted %d", test.impliedPort, n, test.peers)
+		}
+	}
+	want := util.DottedPortToBinary(addr.String())
+	if peers := d.peerStore.PeerContacts(util.InfoHash("bbbbbbbbbbbbbbbbbbbb")); len(peers) != 1 || peers[0] != want {
+		t.Errorf("got peers %q, wanted %q", peers, want)
+	}
+}
@@ -0,0 +1,174 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"dht/remoteNode"
+	"dht/util"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// fakeNode adds to the routing table of d a node that replies to get_peers
+// with a token, and sends the arguments of the announce_peer queries it
+// receives to the returned channel.
+func fakeNode(t *testing.T, d *DHT) <-chan map[string]interface{} {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	id := randNodeID(t)
+	if _, err := d.getOrCreateNode(id, conn.LocalAddr().String(), remoteNode.SourceAdded); err != nil {
+		t.Fatalf("getOrCreateNode: %v", err)
+	}
+	announces := make(chan map[string]interface{}, 10)
+	go func() {
+		for {
+			b := make([]byte, remoteNode.MaxUDPPacketSize)
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			v, err := bencode.Decode(bytes.NewReader(b[:n]))
+			if err != nil {
+				continue
+			}
+			q, _ := v.(map[string]interface{})
+			r := map[string]interface{}{"id": id}
+			switch q["q"] {
+			case "get_peers":
+				r["token"] = "secret"
+			case "announce_peer":
+				a, _ := q["a"].(map[string]interface{})
+				announces <- a
+			}
+			var reply bytes.Buffer
+			bencode.Marshal(&reply, map[string]interface{}{"t": q["t"], "y": "r", "r": r})
+			conn.WriteToUDP(reply.Bytes(), addr)
+		}
+	}()
+	return announces
+}
+
+// waitAnnounce waits until the announce of ih was acknowledged.
+func waitAnnounce(t *testing.T, d *DHT, ih util.InfoHash) AnnounceStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := d.AnnounceStatus()[ih]
+		if len(s.Report) > 0 && s.Report[0].OK {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("announce not acknowledged, status %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScheduledAnnounce(t *testing.T) {
+	ih := testInfoHash
+	d := newTestDHT(t, func(c *Config) {
+		c.AnnouncePeriod = time.Hour
+		c.AnnounceLookupTime = 100 * time.Millisecond
+	})
+	announces := fakeNode(t, d)
+	d.peerStore.AddLocalDownload(ih, 6881)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+
+	s := waitAnnounce(t, d, ih)
+	if s.Nodes != 1 || s.Err != "" || s.Port != 6881 || s.LastAnnounce.IsZero() {
+		t.Errorf("unexpected announce status %+v", s)
+	}
+	if min := s.LastAnnounce.Add(d.config.AnnouncePeriod * 4 / 5); s.NextAnnounce.Before(min) || s.NextAnnounce.After(s.LastAnnounce.Add(d.config.AnnouncePeriod)) {
+		t.Errorf("next announce at %v, wanted within a fifth of the period before %v", s.NextAnnounce, s.LastAnnounce.Add(d.config.AnnouncePeriod))
+	}
+	select {
+	case a := <-announces:
+		if a["token"] != "secret" || a["info_hash"] != string(ih) || a["port"] != int64(6881) {
+			t.Errorf("unexpected announce arguments %v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the remote node received no announce")
+	}
+}
+
+func TestAnnounceAfterConvergence(t *testing.T) {
+	ih := testInfoHash
+	d := newTestDHT(t, func(c *Config) {
+		// Only convergence can end the lookup during the test.
+		c.AnnounceLookupTime = time.Hour
+	})
+	announces := fakeNode(t, d)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+
+	d.PeersRequestPort(string(ih), true, 6881)
+	s := waitAnnounce(t, d, ih)
+	if len(s.Report) != 1 || s.Report[0].Err != "" {
+		t.Errorf("unexpected announce report %+v", s.Report)
+	}
+	<-announces
+
+	// Replies to get_peers outside of an announce lookup don't cause
+	// announces.
+	d.PeersRequestPort(string(ih), true, 6881)
+	select {
+	case a := <-announces:
+		t.Errorf("unexpected announce %v", a)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestAnnounceOptions(t *testing.T) {
+	ih := testInfoHash
+	d := newTestDHT(t, nil)
+	announces := fakeNode(t, d)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+
+	d.PeersRequestOptions(string(ih), SearchOptions{Announce: true, Port: 6881, ImpliedPort: true, Seed: true})
+	select {
+	case a := <-announces:
+		if a["port"] != int64(6881) || a["implied_port"] != int64(1) || a["seed"] != int64(1) {
+			t.Errorf("unexpected announce arguments %v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the remote node received no announce")
+	}
+}
+
+func TestAnnounceLookupTimeout(t *testing.T) {
+	ih := util.InfoHash(randNodeID(t))
+	d := newTestDHT(t, nil)
+	r, err := d.getOrCreateNode(randNodeID(t), "10.0.0.1:6881", remoteNode.SourceAdded)
+	if err != nil {
+		t.Fatalf("getOrCreateNode: %v", err)
+	}
+	l := &announceLookup{
+		started:    time.Now(),
+		queried:    map[string]bool{r.Address.String(): true},
+		pending:    map[string]string{r.Address.String(): r.ID},
+		responders: make(map[string]announceResponder),
+	}
+	d.announces[ih] = &announceState{lookup: l}
+	r.PendingQueries[r.NewQuery("get_peers")].IH = ih
+
+	d.expireQueries(time.Now().Add(remoteNode.QueryTimeout))
+	if len(l.pending) != 0 {
+		t.Errorf("lookup still waits for %v after the query timed out", l.pending)
+	}
+	if s := d.announces[ih]; s.lookup != nil || s.status.Err == "" {
+		t.Errorf("lookup not finished after its last query timed out, status %+v", s.status)
+	}
+}
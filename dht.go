@@ -28,16 +28,15 @@ package dht
 //
 
 import (
-	"crypto/rand"
-	"crypto/sha1"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dht/logger"
@@ -46,6 +45,8 @@ import (
 	"dht/routingTable"
 	"dht/util"
 	"dht/util/arena"
+
+	"github.com/golang/groupcache/lru"
 )
 
 // Config for the DHT Node. Use NewConfig to create a configuration with default values.
@@ -54,35 +55,148 @@ type Config struct {
 	Address string
 	// UDP port the DHT node should listen on. If zero, it picks a random port.
 	Port int
-	// Number of peers that DHT will try to find for each infohash being searched. This might
-	// later be moved to a per-infohash option. Default value: 5.
+	// Number of peers that DHT will try to find for each infohash being searched, unless
+	// PeersRequestOptions sets another target. Default value: 5.
 	NumTargetPeers int
 	// Comma separated list of DHT routers used for bootstrapping the network.
 	DHTRouters string
 	// Maximum number of nodes to store in the routing table. Default value: 100.
 	MaxNodes int
+	// Maximum number of nodes with the same IP address in the routing table, to make flooding
+	// it with Sybil nodes harder. Nodes added with ADDHonestPeer are exempt. Disabled if zero.
+	// Default value: 2.
+	MaxNodesPerIP int
+	// Like MaxNodesPerIP, for nodes in the same /24 (IPv4) or /64 (IPv6) subnet. Default value: 16.
+	MaxNodesPerSubnet int
+	// Like MaxNodesPerIP, but only for the closest nodes to our own ID. Default value: 1.
+	MaxNeighborsPerIP int
+	// Like MaxNodesPerSubnet, but only for the closest nodes to our own ID. Default value: 2.
+	MaxNeighborsPerSubnet int
+	// If true, nodes on loopback addresses are exempt from the limits above, so that several
+	// nodes can run on the same host for testing. Default value: false.
+	ExemptLoopbackNodes bool
+	// RoutingTableType selects the routing table implementation: "tree" for a bucketless
+	// binary tree, or "kbucket" for standard Kademlia k-buckets. Default value: "tree".
+	RoutingTableType string
 	// How often to ping nodes in the network to see if they are reachable. Default value: 15 min.
 	CleanupPeriod time.Duration
+	// Maximum time the routing table cleanup may run at once. Larger tables are checked a
+	// bit at a time, with packets handled in between. If zero, the whole table is checked
+	// in one pass. Default value: 5 ms.
+	CleanupBudget time.Duration
+	// Regions of the routing table that weren't looked up for this long are refreshed with a
+	// find_node for a random ID in them. Disabled if zero. Default value: 15 min.
+	RefreshPeriod time.Duration
 	//  If true, the node will read the routing table from disk on startup and save routing
 	//  table snapshots on disk every few minutes. Default value: true.
 	SaveRoutingTable bool
 	// How often to save the routing table to disk. Default value: 5 minutes.
 	SavePeriod time.Duration
+	// If true, and SaveRoutingTable is set, the infohashes we are downloading are saved with
+	// the routing table, and announced again after a restart without waiting for
+	// PeersRequest calls. Default value: true.
+	ResumeDownloads bool
+	// How often to announce again the infohashes we are downloading, with a fresh lookup. It
+	// should be shorter than the time remote nodes keep peers, usually 30 min. Each announce
+	// comes up to a fifth earlier, at random. If zero, infohashes are only announced when
+	// PeersRequest is called. Default value: 15 min.
+	AnnouncePeriod time.Duration
+	// Maximum time the lookup before an announce runs, if it doesn't converge earlier. Nodes
+	// that don't acknowledge the announce within this time are reported as failed. Default
+	// value: 5 s.
+	AnnounceLookupTime time.Duration
 	// Maximum packets per second to be processed. Disabled if negative. Default value: 100.
 	RateLimit int64
 	// MaxInfoHashes is the limit of number of infohashes for which we should keep a peer list.
 	// If this and MaxInfoHashPeers are unchanged, it should consume around 25 MB of RAM. Larger
-	// values help keeping the DHT network healthy. Default value: 2048.
+	// values help keeping the DHT network healthy. Use MemoryBudget to bound the memory itself.
+	// Default value: 2048.
 	MaxInfoHashes int
 	// MaxInfoHashPeers is the limit of number of peers to be tracked for each infohash. A
 	// single peer contact typically consumes 6 bytes. Default value: 256.
 	MaxInfoHashPeers int
+	// Peer contacts are dropped if they don't announce again within this period, as
+	// suggested by BEP 5. Disabled if zero. Default value: 30 min.
+	PeerTTL time.Duration
+	// MemoryBudget is the memory in bytes the routing table and the peer store may use, as
+	// estimated by them. The routing table may take up to half of it, beyond which new nodes
+	// are only kept as replacement candidates, up to 8 per region of the table, and the
+	// bootstrap routers and trusted nodes are still added. The peer store gets what the routing
+	// table leaves, and evicts the least recently used infohashes to stay within it. The limits
+	// on counts still apply. Disabled if zero. Default value: 0.
+	MemoryBudget int64
+	// If positive, the peers returned by get_peers replies are only stored and sent to
+	// PeersRequestResults once nodes in this many different /24 (IPv4) or /64 (IPv6) subnets
+	// returned them, or PeerVerifier approved them. Up to MaxInfoHashPeers peers per infohash
+	// are kept while they wait, the least recently returned are dropped first. Default value: 0.
+	PeerQuorum int
+	// PeerVerifier, if set, checks each peer returned by get_peers replies, which is stored and
+	// reported as soon as it approves it. Peers returned while too many checks are running are
+	// checked the next time they are returned, and rejected peers are checked again if returned
+	// after 10 minutes. Default value: nil.
+	PeerVerifier PeerVerifier
+	// PeerStore keeps the peers announced to us. If nil, a peer.MemoryPeerStore configured
+	// with MaxInfoHashes and MaxInfoHashPeers is used. Use a peer.BoltPeerStore to keep
+	// the peers across restarts.
+	PeerStore peer.PeerStore
+	// Maximum number of announces of the same infohash accepted from one IP during
+	// AnnounceLimitWindow. Legitimate peers announce again every 15 to 30 minutes, but more
+	// announces are needed for several peers behind the same NAT. Disabled if zero. Default
+	// value: 8.
+	MaxAnnouncesPerInfoHash int
+	// Maximum number of infohashes one IP may announce during AnnounceLimitWindow. Disabled if
+	// zero. Default value: 64.
+	MaxInfoHashesPerSource int
+	// Window for MaxAnnouncesPerInfoHash and MaxInfoHashesPerSource. It starts with the first
+	// announce of each IP. Default value: 30 min.
+	AnnounceLimitWindow time.Duration
+	// If true, announces of port 0 and of other ports below 1024 are not stored. Default
+	// value: false.
+	RejectPrivilegedPorts bool
 	// ClientPerMinuteLimit protects against spammy clients. Ignore their requests if exceeded
 	// this number of packets per minute. Default value: 50.
 	ClientPerMinuteLimit int
 	// ThrottlerTrackedClients is the number of hosts the client throttler remembers. An LRU is used to
 	// track the most interesting ones. Default value: 1000.
 	ThrottlerTrackedClients int64
+	// SubnetPerMinuteLimit is like ClientPerMinuteLimit, but for all hosts in the same /24 (IPv4)
+	// or /64 (IPv6) subnet. Disabled if zero. Default value: 500.
+	SubnetPerMinuteLimit int
+	// ClientBlockDuration is how long a host or subnet that exceeded its limit stays blocked.
+	// Default value: 10 min.
+	ClientBlockDuration time.Duration
+	// Comma separated list of IPs or CIDRs that are never throttled.
+	ThrottlerAllowlist string
+	// TokenSecretLength is the length in bytes of the secrets used to generate announce tokens.
+	// Default value: 20.
+	TokenSecretLength int
+	// How often to rotate the token secrets. Tokens are valid for up to twice this period.
+	// Disabled if zero. Default value: 5 min.
+	TokenRotatePeriod time.Duration
+	// If true, announce tokens are only valid for the infohash they were issued for.
+	// Default value: false.
+	TokenBindInfoHash bool
+	// TokenManager issues and checks announce tokens. If nil, an HMACTokenManager configured
+	// with TokenSecretLength and TokenBindInfoHash is used.
+	TokenManager TokenManager
+	// SpiderSink enables spider mode: every get_peers and announce_peer query received is
+	// recorded to it. Default value: nil.
+	SpiderSink InfoHashSink
+	// How often a spider picks a new random node ID, to cover more of the keyspace. The
+	// rotated IDs are not saved to disk. Disabled if zero. Default value: 0.
+	SpiderIDRotatePeriod time.Duration
+	// If true, replies to get_peers and find_node use a node ID close to the target, which
+	// attracts more announce_peer queries. Default value: false.
+	SpiderNeighborIDs bool
+	// Supernode enables the mode for bootstrap and router nodes: never announce, reply to
+	// get_peers with both peers and nodes, drop the query history of nodes during cleanup to
+	// save memory and crawl the network in the background. Nodes that go bad are still
+	// removed. Use NewSupernodeConfig for suitable defaults.
+	// Default value: false.
+	Supernode bool
+	// How often a supernode looks up a random ID to discover new nodes, while the routing table
+	// is not full. Default value: 1 min.
+	SupernodeCrawlPeriod time.Duration
 	// Protocol for UDP connections, udp4= IPv4, udp6 = IPv6
 	UDPProto string
 	//
@@ -98,14 +212,33 @@ func NewConfig() *Config {
 		NumTargetPeers:          5,
 		DHTRouters:              "router.magnets.im:6881,router.bittorrent.com:6881,dht.transmissionbt.com:6881",
 		MaxNodes:                500,
+		MaxNodesPerIP:           2,
+		MaxNodesPerSubnet:       16,
+		MaxNeighborsPerIP:       1,
+		MaxNeighborsPerSubnet:   2,
+		RoutingTableType:        "tree",
 		CleanupPeriod:           15 * time.Minute,
+		CleanupBudget:           5 * time.Millisecond,
+		RefreshPeriod:           15 * time.Minute,
 		SaveRoutingTable:        true,
 		SavePeriod:              5 * time.Minute,
+		ResumeDownloads:         true,
+		AnnouncePeriod:          15 * time.Minute,
+		AnnounceLookupTime:      5 * time.Second,
 		RateLimit:               100,
 		MaxInfoHashes:           2048,
 		MaxInfoHashPeers:        256,
+		PeerTTL:                 30 * time.Minute,
+		MaxAnnouncesPerInfoHash: 8,
+		MaxInfoHashesPerSource:  64,
+		AnnounceLimitWindow:     30 * time.Minute,
 		ClientPerMinuteLimit:    50,
 		ThrottlerTrackedClients: 1000,
+		SubnetPerMinuteLimit:    500,
+		ClientBlockDuration:     10 * time.Minute,
+		TokenSecretLength:       20,
+		TokenRotatePeriod:       5 * time.Minute,
+		SupernodeCrawlPeriod:    time.Minute,
 		UDPProto:                "udp4",
 		StartHTTPServer:         true,
 	}
@@ -125,16 +258,25 @@ func RegisterFlags(c *Config) {
 		"Maximum number of nodes to store in the routing table, in memory. This is the primary configuration for how noisy or aggressive this node should be. When the node starts, it will try to reach d.config.MaxNodes/2 as quick as possible, to form a healthy routing table.")
 	flag.DurationVar(&c.CleanupPeriod, "cleanupPeriod", c.CleanupPeriod,
 		"How often to ping nodes in the network to see if they are reachable.")
+	flag.DurationVar(&c.CleanupBudget, "cleanupBudget", c.CleanupBudget,
+		"Maximum time the routing table cleanup may block packet handling at once. Zero checks the whole table in one pass.")
 	flag.DurationVar(&c.SavePeriod, "savePeriod", c.SavePeriod,
 		"How often to save the routing table to disk.")
+	flag.BoolVar(&c.ResumeDownloads, "resumeDownloads", c.ResumeDownloads,
+		"Save the infohashes we are downloading with the routing table, and announce them again after a restart.")
+	flag.Int64Var(&c.MemoryBudget, "memoryBudget", c.MemoryBudget,
+		"Memory in bytes the routing table and the peer store may use. Zero disables the budget.")
+	flag.DurationVar(&c.AnnouncePeriod, "announcePeriod", c.AnnouncePeriod,
+		"How often to announce again the infohashes we are downloading. Zero only announces them when the client asks for peers.")
 	flag.Int64Var(&c.RateLimit, "rateLimit", c.RateLimit,
 		"Maximum packets per second to be processed. Beyond this limit they are silently dropped. Set to -1 to disable rate limiting.")
 }
 
 const (
 	// Try to ensure that at least these many nodes are in the routing table.
-	minNodes           = 16
-	secretRotatePeriod = 5 * time.Minute
+	minNodes = 16
+	// How often to estimate the memory used by the routing table.
+	memoryCheckPeriod = 10 * time.Second
 )
 
 // DHT should be created by New(). It provides DHT features to a torrent
@@ -148,6 +290,9 @@ type DHT struct {
 	// Logger contains hooks for a client to attach for certain RPCs.
 	// Hooks is a better name for the job but we don't want to change it and break existing users.
 	Logger Logger
+	// Hooks receives structured events for every RPC and for changes to the routing table
+	// and peer store. It supersedes Logger, which is still supported.
+	Hooks Hooks
 	// DebugLogger is called with log messages.
 	// By default, nothing is printed to the output from the library.
 	// If you want to see log messages, you have to provide a DebugLogger implementation.
@@ -155,8 +300,8 @@ type DHT struct {
 
 	nodeId                 string
 	config                 Config
-	routingTable           *routingTable.RoutingTable
-	peerStore              *peer.PeerStore
+	routingTable           RoutingTable
+	peerStore              peer.PeerStore
 	conn                   *net.UDPConn
 	exploredNeighborhood   bool
 	RemoteNodeAcquaintance chan string
@@ -164,12 +309,29 @@ type DHT struct {
 	nodesRequest           chan ihReq
 	pingRequest            chan *remoteNode.RemoteNode
 	portRequest            chan int
+	calls                  chan func()
+	running                atomic.Bool
+	loopDone               chan struct{}
 	removeInfoHash         chan util.InfoHash
 	stop                   chan bool
 	wg                     sync.WaitGroup
 	clientThrottle         *util.ClientThrottle
 	store                  *dhtStore
-	tokenSecrets           []string
+	tokens                 TokenManager
+	announceLimits         *announceLimiter
+	announces              map[util.InfoHash]*announceState
+	searches               map[util.InfoHash]*search
+	// Peers being validated, see peer_validation.go. Keyed by infohash,
+	// values are map[string]*peerCandidate.
+	peerCandidates    *lru.Cache
+	peerVerifications chan struct{}
+	// Memory used by the queries of the routing table nodes when it was
+	// last estimated, see updateMemory. The nodes themselves are accounted
+	// by the table as they're added and removed.
+	routingTableQueryBytes int64
+	// Local downloads changed since the store was last saved. The next
+	// saveTicker tick, or Stop, writes them.
+	downloadsDirty bool
 }
 
 // New creates a DHT node. If config is nil, DefaultConfig will be used.
@@ -184,7 +346,6 @@ func New(config *Config) (node *DHT, err error) {
 	cfg := *config
 	node = &DHT{
 		config:               cfg,
-		peerStore:            peer.NewPeerStore(cfg.MaxInfoHashes, cfg.MaxInfoHashPeers),
 		PeersRequestResults:  make(chan map[util.InfoHash][]string, 1),
 		stop:                 make(chan bool),
 		DebugLogger:          &logger.NullLogger{},
@@ -196,12 +357,57 @@ func New(config *Config) (node *DHT, err error) {
 		nodesRequest:   make(chan ihReq, 100),
 		pingRequest:    make(chan *remoteNode.RemoteNode),
 		portRequest:    make(chan int),
+		calls:          make(chan func()),
+		loopDone:       make(chan struct{}),
 		removeInfoHash: make(chan util.InfoHash),
-		clientThrottle: util.NewThrottler(cfg.ClientPerMinuteLimit, cfg.ThrottlerTrackedClients),
+		announces:      make(map[util.InfoHash]*announceState),
+		searches:       make(map[util.InfoHash]*search),
+	}
+	node.clientThrottle, err = util.NewThrottlerWithConfig(util.ThrottleConfig{
+		MaxPerMinute:       cfg.ClientPerMinuteLimit,
+		MaxSubnetPerMinute: cfg.SubnetPerMinuteLimit,
+		MaxHosts:           cfg.ThrottlerTrackedClients,
+		BlockDuration:      cfg.ClientBlockDuration,
+		Allowlist:          strings.Split(cfg.ThrottlerAllowlist, ","),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var table *routingTable.RoutingTable
+	switch cfg.RoutingTableType {
+	case "", "tree":
+		table = routingTable.NewRoutingTable(&node.DebugLogger)
+	case "kbucket":
+		table = routingTable.NewKBucketRoutingTable("", &node.DebugLogger)
+	default:
+		return nil, fmt.Errorf("unknown routing table type %q", cfg.RoutingTableType)
+	}
+	table.Hooks = hooks{node}
+	table.DiversityLimits = routingTable.DiversityLimits{
+		PerIP:                 cfg.MaxNodesPerIP,
+		PerSubnet:             cfg.MaxNodesPerSubnet,
+		NeighborhoodPerIP:     cfg.MaxNeighborsPerIP,
+		NeighborhoodPerSubnet: cfg.MaxNeighborsPerSubnet,
+		ExemptLoopback:        cfg.ExemptLoopbackNodes,
+	}
+	if cfg.Supernode {
+		table.KeepNodes = true
+	}
+	node.routingTable = table
+	node.peerStore = cfg.PeerStore
+	if node.peerStore == nil {
+		node.peerStore = peer.NewMemoryPeerStore(cfg.MaxInfoHashes, cfg.MaxInfoHashPeers)
+	}
+	node.peerStore.SetHooks(hooks{node})
+	node.peerStore.SetPeerTTL(cfg.PeerTTL)
+	node.peerStore.SetMemoryLimit(cfg.MemoryBudget)
+	node.announceLimits = newAnnounceLimiter(cfg.AnnounceLimitWindow, cfg.MaxAnnouncesPerInfoHash, cfg.MaxInfoHashesPerSource, cfg.ThrottlerTrackedClients)
+	node.peerCandidates = lru.New(cfg.MaxInfoHashes)
+	node.peerVerifications = make(chan struct{}, maxPeerVerifications)
+	node.tokens = cfg.TokenManager
+	if node.tokens == nil {
+		node.tokens = NewHMACTokenManager(cfg.TokenSecretLength, cfg.TokenBindInfoHash)
 	}
-	routingTable := routingTable.NewRoutingTable(&node.DebugLogger)
-	node.routingTable = routingTable
-	node.tokenSecrets = []string{node.newTokenSecret(), node.newTokenSecret()}
 	c := openStore(cfg.Port, cfg.SaveRoutingTable)
 	node.store = c
 	if len(c.Id) != 20 {
@@ -215,9 +421,19 @@ func New(config *Config) (node *DHT, err error) {
 	}
 	// The types don't match because JSON marshalling needs []byte.
 	node.nodeId = string(c.Id)
+	if cfg.ResumeDownloads {
+		for x, port := range c.Downloads {
+			if ih, err := util.DecodeInfoHash(x); err == nil && port > 0 {
+				node.peerStore.AddLocalDownload(ih, port)
+				if options, ok := c.Searches[x]; ok {
+					node.searches[ih] = &search{options: options, started: time.Now()}
+				}
+			}
+		}
+	}
 
 	// XXX refactor.
-	node.routingTable.NodeID = node.nodeId
+	node.routingTable.SetNodeID(node.nodeId)
 
 	// This is called before the engine is up and ready to read from the
 	// underlying channel.
@@ -231,29 +447,55 @@ func New(config *Config) (node *DHT, err error) {
 	return
 }
 
-func (d *DHT) newTokenSecret() string {
-	b := make([]byte, 5)
-	if _, err := rand.Read(b); err != nil {
-		// This would return a string with up to 5 null chars.
-		d.DebugLogger.Errorf("DHT: failed to generate random newTokenSecret: %v", err)
-	}
-	return string(b)
-}
-
 // Logger allows the DHT client to attach hooks for certain RPCs so it can log
 // interesting events any way it wants.
 type Logger interface {
 	GetPeers(addr net.UDPAddr, queryID string, infoHash util.InfoHash)
 }
 
+// AnnounceLogger is an optional extension of Logger. If the Logger also
+// implements it, AnnouncePeer is called for every announce_peer query with a
+// valid token.
+type AnnounceLogger interface {
+	AnnouncePeer(addr net.UDPAddr, queryID string, infoHash util.InfoHash, port int)
+}
+
 type ihReq struct {
-	ih      util.InfoHash
-	options announceOptions
+	ih util.InfoHash
+	// Nil for the requests that don't come from the client, which use the
+	// stored options of the infohash.
+	options *SearchOptions
 }
 
-type announceOptions struct {
-	announce bool
-	port     int
+// SearchOptions are the options of a search for the peers of an infohash,
+// see PeersRequestOptions.
+type SearchOptions struct {
+	// Announce should be true if we are downloading the infohash, see
+	// PeersRequest.
+	Announce bool
+	// Port to announce. If zero, Config.Port is used.
+	Port int
+	// Ask the nodes we announce to to use the source port of our packets
+	// instead of Port, as described in BEP 5.
+	ImpliedPort bool
+	// Announce that we are a seed for the infohash, as described in BEP 33.
+	Seed bool
+	// Number of peers to find. If zero, Config.NumTargetPeers is used.
+	TargetPeers int
+	// When several requests are pending, those with a higher priority are
+	// served first.
+	Priority int
+	// The search stops looking for more peers after this time, and the
+	// lookup before each announce runs for at most this time. If zero, the
+	// search never stops, and Config.AnnounceLookupTime is used for the
+	// announces.
+	LookupDeadline time.Duration
+}
+
+// search is a search requested by the client.
+type search struct {
+	options SearchOptions
+	started time.Time
 }
 
 // PeersRequest asks the DHT to search for more peers for the infoHash
@@ -267,7 +509,16 @@ func (d *DHT) PeersRequest(ih string, announce bool) {
 
 // PeersRequestPort is same as PeersRequest but it takes additional port argument to use in "announce_peer" request.
 func (d *DHT) PeersRequestPort(ih string, announce bool, port int) {
-	d.peersRequest <- ihReq{util.InfoHash(ih), announceOptions{announce, port}}
+	d.PeersRequestOptions(ih, SearchOptions{Announce: announce, Port: port})
+}
+
+// PeersRequestOptions is like PeersRequest, with options for the search. The
+// options are kept for the infohash, and replaced by the next request for it.
+func (d *DHT) PeersRequestOptions(ih string, options SearchOptions) {
+	if options.Port == 0 {
+		options.Port = d.config.Port
+	}
+	d.peersRequest <- ihReq{util.InfoHash(ih), &options}
 	d.DebugLogger.Infof("DHT: torrent client asking more peers for %x.", ih)
 }
 
@@ -291,6 +542,37 @@ func (d *DHT) Port() int {
 	return <-d.portRequest
 }
 
+// do runs f on the main loop goroutine, which owns the routing table, and
+// waits for it to return. If the loop is not running, f is called directly.
+// It must not be called from the loop goroutine, including from Hooks, or it
+// deadlocks: only the loop reads d.calls, and there's no way to tell which
+// goroutine is calling.
+func (d *DHT) do(f func()) {
+	if !d.running.Load() {
+		f()
+		return
+	}
+	done := make(chan bool)
+	select {
+	case d.calls <- func() { f(); close(done) }:
+		<-done
+	case <-d.loopDone:
+		f()
+	}
+}
+
+// BlockedHosts returns the hosts and subnets that are currently blocked by the
+// client throttler, with the time at which each of them will be unblocked.
+func (d *DHT) BlockedHosts() map[string]time.Time {
+	return d.clientThrottle.Blocked()
+}
+
+// UnblockHost lifts the throttler block for host, which can be an IP or a
+// subnet as returned by BlockedHosts. Returns false if it was not blocked.
+func (d *DHT) UnblockHost(host string) bool {
+	return d.clientThrottle.Unblock(host)
+}
+
 // AddNode informs the DHT of a new node it should add to its routing table.
 // addr is a string containing the target node's "host:port" UDP address.
 func (d *DHT) AddNode(addr string) {
@@ -299,11 +581,12 @@ func (d *DHT) AddNode(addr string) {
 
 // Asks for more peers for a torrent.
 func (d *DHT) getPeers(infoHash util.InfoHash) {
+	d.routingTable.Touch(string(infoHash))
 	closest := d.routingTable.LookupFiltered(infoHash)
 	if len(closest) == 0 {
 		for _, s := range strings.Split(d.config.DHTRouters, ",") {
 			if s != "" {
-				r, e := d.routingTable.GetOrCreateNode("", s, d.config.UDPProto)
+				r, e := d.getOrCreateNode("", s, remoteNode.SourceRouter)
 				if e == nil {
 					d.getPeersFrom(r, infoHash)
 				}
@@ -317,12 +600,13 @@ func (d *DHT) getPeers(infoHash util.InfoHash) {
 
 // Find a DHT node.
 func (d *DHT) findNode(id string) {
+	d.routingTable.Touch(id)
 	ih := util.InfoHash(id)
 	closest := d.routingTable.LookupFiltered(ih)
 	if len(closest) == 0 {
 		for _, s := range strings.Split(d.config.DHTRouters, ",") {
 			if s != "" {
-				r, e := d.routingTable.GetOrCreateNode("", s, d.config.UDPProto)
+				r, e := d.getOrCreateNode("", s, remoteNode.SourceRouter)
 				if e == nil {
 					d.findNodeFrom(r, id)
 				}
@@ -342,6 +626,7 @@ func (d *DHT) findNode(id string) {
 // by the caller to stop the dht
 func (d *DHT) Start() (err error) {
 	if err = d.initSocket(); err == nil {
+		d.running.Store(true)
 		d.wg.Add(1)
 		go func() {
 			defer d.wg.Done()
@@ -362,6 +647,7 @@ func (d *DHT) Run() error {
 	if err := d.initSocket(); err != nil {
 		return err
 	}
+	d.running.Store(true)
 	d.loop()
 	return nil
 }
@@ -384,8 +670,8 @@ func (d *DHT) bootstrap() {
 	// Bootstrap the network (only if there are configured dht routers).
 	for _, s := range strings.Split(d.config.DHTRouters, ",") {
 		if s != "" {
-			d.ping(s)
-			r, e := d.routingTable.GetOrCreateNode("", s, d.config.UDPProto)
+			d.ping(s, remoteNode.SourceRouter)
+			r, e := d.getOrCreateNode("", s, remoteNode.SourceRouter)
 			if e == nil {
 				d.findNodeFrom(r, d.nodeId)
 			}
@@ -402,6 +688,7 @@ func (d *DHT) bootstrap() {
 func (d *DHT) loop() {
 	// Close socket
 	defer d.conn.Close()
+	defer close(d.loopDone)
 
 	// There is goroutine pushing and one popping items out of the arena.
 	// One passes work to the other. So there is little contention in the
@@ -419,7 +706,43 @@ func (d *DHT) loop() {
 	d.bootstrap()
 
 	cleanupTicker := time.NewTicker(d.config.CleanupPeriod).C
-	secretRotateTicker := time.NewTicker(secretRotatePeriod).C
+	// Set while a cleanup sweep is in progress.
+	var cleanupStep <-chan time.Time
+
+	var secretRotateTicker <-chan time.Time
+	if d.config.TokenRotatePeriod > 0 {
+		secretRotateTicker = time.NewTicker(d.config.TokenRotatePeriod).C
+	}
+	var nodeIDRotateTicker <-chan time.Time
+	if d.config.SpiderIDRotatePeriod > 0 {
+		nodeIDRotateTicker = time.NewTicker(d.config.SpiderIDRotatePeriod).C
+	}
+	var refreshTicker <-chan time.Time
+	if d.config.RefreshPeriod > 0 {
+		// Check often enough that regions aren't left stale for much
+		// longer than RefreshPeriod.
+		refreshTicker = time.NewTicker(d.config.RefreshPeriod / 5).C
+	}
+	var crawlTicker <-chan time.Time
+	if d.config.Supernode && d.config.SupernodeCrawlPeriod > 0 {
+		crawlTicker = time.NewTicker(d.config.SupernodeCrawlPeriod).C
+	}
+
+	var announceTicker <-chan time.Time
+	if !d.config.Supernode {
+		// Often enough for the lookup deadlines.
+		tick := time.Second
+		if t := d.config.AnnounceLookupTime; t > 0 && t < tick {
+			tick = t
+		}
+		announceTicker = time.NewTicker(tick).C
+	}
+
+	// Often enough for the shortest query timeouts.
+	expiryTicker := time.NewTicker(remoteNode.MinQueryTimeout).C
+
+	d.updateMemory()
+	memoryTicker := time.NewTicker(memoryCheckPeriod).C
 
 	saveTicker := make(<-chan time.Time)
 	if d.store != nil {
@@ -451,6 +774,9 @@ func (d *DHT) loop() {
 		case <-d.stop:
 			d.DebugLogger.Infof("DHT exiting.")
 			d.clientThrottle.Stop()
+			if d.downloadsDirty {
+				d.save()
+			}
 			return
 		case addr := <-d.RemoteNodeAcquaintance:
 			d.helloFromPeer(addr)
@@ -460,28 +786,62 @@ func (d *DHT) loop() {
 			// PeersNeededResults channel.
 
 			// Drain all requests sitting in the channel and de-dupe them.
-			m := map[util.InfoHash]announceOptions{req.ih: req.options}
+			// The value is true if the client asked for the infohash.
+			m := make(map[util.InfoHash]bool)
+			add := func(req ihReq) {
+				if req.options != nil {
+					d.setSearch(req.ih, *req.options)
+				}
+				m[req.ih] = m[req.ih] || req.options != nil
+			}
+			add(req)
 		P:
 			for {
 				select {
 				case req = <-d.peersRequest:
-					m[req.ih] = req.options
+					add(req)
 				default:
 					// Channel drained.
 					break P
 				}
 			}
-			// Process each unique infohash for which there were requests.
-			for ih, options := range m {
-				if options.announce {
-					d.peerStore.AddLocalDownload(ih, options.port)
+			// Process each unique infohash for which there were requests,
+			// highest priority first.
+			ihs := make([]util.InfoHash, 0, len(m))
+			for ih := range m {
+				ihs = append(ihs, ih)
+			}
+			sort.Slice(ihs, func(i, j int) bool {
+				return d.searchOptions(ihs[i]).Priority > d.searchOptions(ihs[j]).Priority
+			})
+			downloadsChanged := false
+			for _, ih := range ihs {
+				if options := d.searchOptions(ih); m[ih] && options.Announce && !d.config.Supernode {
+					changed := d.peerStore.HasLocalDownload(ih) != options.Port
+					if changed {
+						d.peerStore.AddLocalDownload(ih, options.Port)
+						downloadsChanged = true
+					}
+					if changed || d.config.AnnouncePeriod <= 0 {
+						// The announce lookup also finds peers.
+						d.startAnnounce(ih, time.Now())
+						continue
+					}
 				}
 
 				d.getPeers(ih) // I might have enough peers in the peerstore, but no seeds
 			}
+			if downloadsChanged && d.config.ResumeDownloads {
+				d.downloadsDirty = true
+			}
 
 		case ih := <-d.removeInfoHash:
 			d.peerStore.RemoveLocalDownload(ih)
+			delete(d.announces, ih)
+			delete(d.searches, ih)
+			if d.config.ResumeDownloads {
+				d.downloadsDirty = true
+			}
 		case req := <-d.nodesRequest:
 			m := map[util.InfoHash]bool{req.ih: true}
 		L:
@@ -518,42 +878,189 @@ func (d *DHT) loop() {
 				tokenBucket += d.config.RateLimit / 10
 			}
 		case <-cleanupTicker:
-			needPing := d.routingTable.Cleanup(d.config.CleanupPeriod, d.peerStore)
-			d.wg.Add(1)
-			go func() {
-				defer d.wg.Done()
-				routingTable.PingSlowly(d.pingRequest, needPing, d.config.CleanupPeriod, d.stop)
-			}()
+			if cleanupStep == nil {
+				cleanupStep = d.cleanupStep()
+			}
 			if d.needMoreNodes() {
 				d.bootstrap()
 			}
+		case <-cleanupStep:
+			cleanupStep = d.cleanupStep()
 		case node := <-d.pingRequest:
 			d.pingNode(node)
 		case <-secretRotateTicker:
-			d.tokenSecrets = []string{d.newTokenSecret(), d.tokenSecrets[0]}
+			d.tokens.Rotate()
+		case <-nodeIDRotateTicker:
+			d.rotateNodeID()
+		case <-refreshTicker:
+			d.refresh()
+		case <-crawlTicker:
+			d.crawl()
+		case now := <-announceTicker:
+			d.announceTick(now)
+		case now := <-expiryTicker:
+			d.expireQueries(now)
 		case d.portRequest <- d.config.Port:
 			continue
+		case f := <-d.calls:
+			f()
 		case <-saveTicker:
-			tbl := d.routingTable.ReachableNodes()
-			if len(tbl) > 5 {
-				d.store.Remotes = tbl
-				saveStore(*d.store)
+			d.save()
+		case <-memoryTicker:
+			d.updateMemory()
+		}
+	}
+}
+
+// expireQueries fails the queries that got no reply within the timeout of
+// their node, which is how nodes go bad.
+func (d *DHT) expireQueries(now time.Time) {
+	var lookups []util.InfoHash
+	d.routingTable.ExpireQueries(now, func(n *remoteNode.RemoteNode, q *remoteNode.QueryType) {
+		totalTimedOutQueries.Add(1)
+		if q.Type != "get_peers" {
+			return
+		}
+		// An announce lookup doesn't wait for nodes that timed out.
+		if l := d.announceLookup(q.IH); l != nil {
+			delete(l.pending, n.Address.String())
+			lookups = append(lookups, q.IH)
+		}
+	})
+	for _, ih := range lookups {
+		if l := d.announceLookup(ih); l != nil && l.converged(ih) {
+			d.finishAnnounce(ih, d.announces[ih], now)
+		}
+	}
+}
+
+// cleanupStep continues the routing table cleanup for up to CleanupBudget.
+// If the sweep isn't done, it returns a channel that fires when the next step
+// is due, after a pause as long as the budget so that packets are handled in
+// between. Otherwise it pings the nodes that need it, spread over the cleanup
+// period, and returns nil.
+func (d *DHT) cleanupStep() <-chan time.Time {
+	needPing, done := d.routingTable.CleanupStep(d.config.CleanupBudget, d.config.CleanupPeriod, d.peerStore)
+	if !done {
+		return time.After(d.config.CleanupBudget)
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		routingTable.PingSlowly(d.pingRequest, needPing, d.config.CleanupPeriod, d.stop)
+	}()
+	return nil
+}
+
+// updateMemory estimates the memory used by the routing table, gives the peer
+// store what is left of MemoryBudget, and publishes the usage.
+func (d *DHT) updateMemory() {
+	usage := d.routingTable.MemoryUsage()
+	d.routingTableQueryBytes = usage - d.routingTable.NodeMemoryUsage()
+	if d.config.MemoryBudget > 0 {
+		limit := d.config.MemoryBudget - usage
+		if limit < 1 {
+			limit = 1
+		}
+		d.peerStore.SetMemoryLimit(limit)
+	}
+	routingTableMemory.Set(usage)
+	peerStoreMemory.Set(d.peerStore.MemoryUsage())
+}
+
+// routingTableMemoryFull reports whether the routing table used its share of
+// MemoryBudget. Its nodes are counted as they are added, their queries as of
+// the last updateMemory.
+func (d *DHT) routingTableMemoryFull() bool {
+	return d.config.MemoryBudget > 0 &&
+		d.routingTable.NodeMemoryUsage()+d.routingTableQueryBytes >= d.config.MemoryBudget/2
+}
+
+// roomForNodes reports whether new nodes may be added to the routing table.
+func (d *DHT) roomForNodes() bool {
+	return d.routingTable.Length() < d.config.MaxNodes && !d.routingTableMemoryFull()
+}
+
+// save writes the routing table, if it has enough reachable nodes, and the
+// local downloads to disk, if SaveRoutingTable is set.
+func (d *DHT) save() {
+	if d.store == nil {
+		return
+	}
+	if tbl := d.routingTable.ReachableNodes(); len(tbl) > 5 {
+		d.store.Remotes = tbl
+	}
+	d.store.Downloads = nil
+	d.store.Searches = nil
+	if d.config.ResumeDownloads {
+		d.store.Downloads = make(map[string]int)
+		d.store.Searches = make(map[string]SearchOptions)
+		for ih, port := range d.peerStore.LocalDownloads() {
+			d.store.Downloads[ih.String()] = port
+			if s, ok := d.searches[ih]; ok {
+				d.store.Searches[ih.String()] = s.options
 			}
 		}
 	}
+	saveStore(*d.store)
+	d.downloadsDirty = false
+}
+
+// refresh looks up a random ID in each region of the routing table that
+// wasn't looked up during the last RefreshPeriod.
+func (d *DHT) refresh() {
+	for _, id := range d.routingTable.RefreshTargets(d.config.RefreshPeriod) {
+		d.DebugLogger.Debugf("DHT: refreshing region with target %x", id)
+		totalRegionRefreshes.Add(1)
+		d.findNode(id)
+	}
 }
 
 func (d *DHT) needMoreNodes() bool {
-	n := d.routingTable.NumNodes()
+	n := d.routingTable.Length()
 	return n < minNodes || n*2 < d.config.MaxNodes
 }
 
 func (d *DHT) needMorePeers(ih util.InfoHash) bool {
-	return d.peerStore.Alive(ih) < d.config.NumTargetPeers
+	target := d.config.NumTargetPeers
+	if s, ok := d.searches[ih]; ok {
+		if s.options.TargetPeers > 0 {
+			target = s.options.TargetPeers
+		}
+		if s.options.LookupDeadline > 0 && time.Since(s.started) > s.options.LookupDeadline {
+			return false
+		}
+	}
+	return d.peerStore.Alive(ih) < target
+}
+
+// setSearch stores the options of a search for ih, and restarts its
+// deadline. Beyond MaxInfoHashes searches, the options of one that is not a
+// local download are dropped.
+func (d *DHT) setSearch(ih util.InfoHash, options SearchOptions) {
+	if _, ok := d.searches[ih]; !ok && len(d.searches) >= d.config.MaxInfoHashes {
+		downloads := d.peerStore.LocalDownloads()
+		for x := range d.searches {
+			if _, ok := downloads[x]; !ok {
+				delete(d.searches, x)
+				break
+			}
+		}
+	}
+	d.searches[ih] = &search{options: options, started: time.Now()}
+}
+
+// searchOptions returns the stored options of the search for ih, or the
+// default ones.
+func (d *DHT) searchOptions(ih util.InfoHash) SearchOptions {
+	if s, ok := d.searches[ih]; ok {
+		return s.options
+	}
+	return SearchOptions{}
 }
 
 func (d *DHT) getMorePeers(r *remoteNode.RemoteNode) {
-	for ih := range d.peerStore.LocalActiveDownloads {
+	for ih := range d.peerStore.LocalDownloads() {
 		if d.needMorePeers(ih) {
 			if r == nil {
 				d.getPeers(ih)
@@ -578,42 +1085,90 @@ func (d *DHT) helloFromPeer(addr string) {
 		// Node host+port already known.
 		return
 	}
-	if d.routingTable.Length() < d.config.MaxNodes {
-		d.ping(addrResolved)
+	if d.roomForNodes() {
+		d.ping(addrResolved, remoteNode.SourceAdded)
 		return
 	}
 }
 
-func (d *DHT) ADDHonestPeer(id, addr string) error {
-	// We've got a new node id. We need to:
-	// - see if we know it already, skip accordingly.
-	// - ping it and see if it's reachable.
-	// - if it responds, save it in the routing table.
-	_, _, existed, err := d.routingTable.HostPortToNode(addr, d.config.UDPProto)
+// ADDHonestPeer adds a node that is trusted by the user to the routing table,
+// or marks it as trusted if it's already there. Trusted nodes are pinned in
+// the table, exempt from its size and diversity limits, and preferred in
+// lookups. With k-buckets, a trusted node takes the place of an untrusted one
+// if its bucket is full, and fails only if the bucket is full of trusted
+// nodes. It is safe to call from any goroutine.
+func (d *DHT) ADDHonestPeer(id, addr string) (err error) {
+	d.do(func() { err = d.addHonestPeer(id, addr) })
+	return err
+}
+
+func (d *DHT) addHonestPeer(id, addr string) error {
+	node, addrResolved, existed, err := d.routingTable.HostPortToNode(addr, d.config.UDPProto)
+	if err != nil {
+		d.DebugLogger.Debugf("AddHonestNode error: %v", err)
+		return err
+	}
 	if existed {
+		d.routingTable.SetTrusted(node, true)
 		return nil
 	}
+	udpAddr, err := net.ResolveUDPAddr(d.config.UDPProto, addrResolved)
 	if err != nil {
 		d.DebugLogger.Debugf("AddHonestNode error: %v", err)
 		return err
 	}
-	if d.routingTable.Length()+1 < d.config.MaxNodes {
-		r, err := d.routingTable.GetOrCreateNode(id, addr, d.config.UDPProto)
-		if err != nil {
-			d.DebugLogger.Debugf("AddHonestNode error: %v", err)
-		}
-		log.Printf("node %v added", &r.Address)
-		d.pingNode(r)
-		return nil
+	r := remoteNode.NewRemoteNode(*udpAddr, id, &d.DebugLogger)
+	r.Honest = true
+	r.Source = remoteNode.SourceHonest
+	if err := d.routingTable.Insert(r, d.config.UDPProto); err != nil {
+		d.DebugLogger.Debugf("AddHonestNode error: %v", err)
+		return err
 	}
+	d.DebugLogger.Debugf("DHT: trusted node %v added", &r.Address)
+	d.pingNode(r)
 	return nil
 }
 
+// HonestPeers returns the trusted nodes added with ADDHonestPeer. It is safe
+// to call from any goroutine.
+func (d *DHT) HonestPeers() (nodes []NodeInfo) {
+	d.do(func() {
+		for _, n := range d.routingTable.Trusted() {
+			nodes = append(nodes, newNodeInfo(n))
+		}
+	})
+	return nodes
+}
+
+// ErrNotTrusted is returned by RemoveHonestPeer when there is no trusted node
+// with the given address.
+var ErrNotTrusted = errors.New("no trusted node with this address")
+
+// RemoveHonestPeer removes the trusted node with the UDP address addr from the
+// routing table. It is safe to call from any goroutine.
+func (d *DHT) RemoveHonestPeer(addr string) (err error) {
+	d.do(func() {
+		node, _, existed, e := d.routingTable.HostPortToNode(addr, d.config.UDPProto)
+		switch {
+		case e != nil:
+			err = e
+		case !existed || !node.Honest:
+			err = fmt.Errorf("%w: %v", ErrNotTrusted, addr)
+		default:
+			d.routingTable.Kill(node, d.peerStore)
+		}
+	})
+	return err
+}
+
 func (d *DHT) processPacket(p remoteNode.PacketType) {
 	d.DebugLogger.Debugf("DHT processing packet from %v", p.Raddr.String())
 	if !d.clientThrottle.CheckBlock(p.Raddr.IP.String()) {
 		totalPacketsFromBlockedHosts.Add(1)
 		d.DebugLogger.Debugf("Node exceeded rate limiter. Dropping packet.")
+		if d.Hooks != nil {
+			d.Hooks.ThrottleBlocked(ThrottleEvent{Addr: p.Raddr})
+		}
 		return
 	}
 	if p.B[0] != 'd' {
@@ -645,9 +1200,13 @@ func (d *DHT) processPacket(p remoteNode.PacketType) {
 			return
 		}
 		if !existed {
+			if c := d.routingTable.Replacement(addr); c != nil {
+				d.verifyReplacement(c, r)
+				return
+			}
 			d.DebugLogger.Debugf("DHT: Received reply from a host we don't know: %v", p.Raddr)
-			if d.routingTable.Length() < d.config.MaxNodes {
-				d.ping(addr)
+			if d.roomForNodes() {
+				d.ping(addr, remoteNode.SourceReply)
 			}
 			return
 		}
@@ -661,11 +1220,28 @@ func (d *DHT) processPacket(p remoteNode.PacketType) {
 		}
 		if query, ok := node.PendingQueries[r.T]; ok {
 			d.DebugLogger.Debugf("DHT: Received reply to %v", query.Type)
+			if d.Hooks != nil {
+				nodes := r.R.Nodes
+				if d.config.UDPProto == "udp6" {
+					nodes = r.R.Nodes6
+				}
+				d.Hooks.ReplyReceived(ReplyEvent{
+					Type:          query.Type,
+					TransactionID: r.T,
+					Addr:          p.Raddr,
+					NodeID:        r.R.Id,
+					Token:         r.R.Token,
+					Nodes:         len(nodes) / d.nodeContactLen(),
+					Values:        len(r.R.Values),
+				})
+			}
 			if !node.Reachable {
 				node.Reachable = true
 				totalNodesReached.Add(1)
 			}
+			node.Replied(query)
 			node.LastResponseTime = time.Now()
+			d.routingTable.Seen(node)
 			node.PastQueries[r.T] = query
 			d.routingTable.NeighborhoodUpkeep(node, d.config.UDPProto, d.peerStore)
 
@@ -688,7 +1264,7 @@ func (d *DHT) processPacket(p remoteNode.PacketType) {
 				d.DebugLogger.Debugf("DHT: got find_node response")
 				d.processFindNodeResults(node, r)
 			case "announce_peer":
-				// Nothing to do. In the future, update counters.
+				d.announceReplied(query.IH, node.Address.String())
 			default:
 				d.DebugLogger.Debugf("DHT: Unknown query type: %v from %v", query.Type, addr)
 			}
@@ -708,11 +1284,27 @@ func (d *DHT) processPacket(p remoteNode.PacketType) {
 		}
 		if !existed {
 			// Another candidate for the routing table. See if it's reachable.
-			if d.routingTable.Length() < d.config.MaxNodes {
-				d.ping(addr)
+			if d.roomForNodes() {
+				d.ping(addr, remoteNode.SourceQuery)
+			} else {
+				d.addReplacement(r.A.Id, p.Raddr)
 			}
+		} else {
+			node.LastQueryTime = time.Now()
 		}
 		d.DebugLogger.Debugf("DHT processing %v request", r.Q)
+		if d.Hooks != nil {
+			d.Hooks.QueryReceived(QueryEvent{
+				Type:          r.Q,
+				TransactionID: r.T,
+				Addr:          p.Raddr,
+				NodeID:        r.A.Id,
+				InfoHash:      r.A.InfoHash,
+				Target:        r.A.Target,
+				Port:          r.A.Port,
+				Token:         r.A.Token,
+			})
+		}
 		switch r.Q {
 		case "ping":
 			d.replyPing(p.Raddr, r)
@@ -730,8 +1322,67 @@ func (d *DHT) processPacket(p remoteNode.PacketType) {
 	}
 }
 
-func (d *DHT) ping(address string) {
-	r, err := d.routingTable.GetOrCreateNode("", address, d.config.UDPProto)
+// addReplacement keeps the node with the given ID and address as a
+// replacement candidate, and pings it to verify it.
+func (d *DHT) addReplacement(id string, addr net.UDPAddr) {
+	if remoteNode.BogusId(id) || d.routingTable.Replacement(addr.String()) != nil {
+		return
+	}
+	n := remoteNode.NewRemoteNode(addr, id, &d.DebugLogger)
+	n.Source = remoteNode.SourceQuery
+	d.routingTable.AddReplacement(n)
+	if d.routingTable.Replacement(addr.String()) == n {
+		d.pingNode(n)
+	}
+}
+
+// verifyReplacement processes a reply from a replacement candidate. Only
+// replies to pings are expected.
+func (d *DHT) verifyReplacement(c *remoteNode.RemoteNode, r remoteNode.ResponseType) {
+	query, ok := c.PendingQueries[r.T]
+	if !ok || r.R.Id != c.ID {
+		d.DebugLogger.Debugf("DHT: unexpected reply from replacement candidate %v", c.Address)
+		return
+	}
+	c.Replied(query)
+	delete(c.PendingQueries, r.T)
+	c.Reachable = true
+	c.LastResponseTime = time.Now()
+	totalVerifiedReplacements.Add(1)
+}
+
+// getOrCreateNode returns the node with the UDP address hostPort, inserting a
+// new one with ID if it's not in the table yet. source is recorded as the
+// way we learned about the node, unless it was already known. Once the
+// routing table used its share of MemoryBudget, new nodes other than the
+// bootstrap routers are only kept as replacement candidates, which take the
+// place of the nodes that go bad.
+func (d *DHT) getOrCreateNode(ID string, hostPort string, source string) (*remoteNode.RemoteNode, error) {
+	if d.routingTableMemoryFull() && source != remoteNode.SourceRouter {
+		r, addr, existed, err := d.routingTable.HostPortToNode(hostPort, d.config.UDPProto)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			return r, nil
+		}
+		if udpAddr, err := net.ResolveUDPAddr(d.config.UDPProto, addr); err == nil {
+			// Pinged by the next cleanup, see cleanupReplacements.
+			n := remoteNode.NewRemoteNode(*udpAddr, ID, &d.DebugLogger)
+			n.Source = source
+			d.routingTable.AddReplacement(n)
+		}
+		return nil, fmt.Errorf("routing table memory budget exceeded, not adding %v", hostPort)
+	}
+	r, err := d.routingTable.GetOrCreateNode(ID, hostPort, d.config.UDPProto)
+	if r != nil && r.Source == "" {
+		r.Source = source
+	}
+	return r, err
+}
+
+func (d *DHT) ping(address string, source string) {
+	r, err := d.getOrCreateNode("", address, source)
 	if err != nil {
 		d.DebugLogger.Debugf("ping error for address %v: %v", address, err)
 		return
@@ -744,8 +1395,8 @@ func (d *DHT) pingNode(r *remoteNode.RemoteNode) {
 	t := r.NewQuery("ping")
 
 	queryArguments := map[string]interface{}{"id": d.nodeId}
-	query := remoteNode.QueryMessage{t, "q", "ping", queryArguments}
-	remoteNode.SendMsg(d.conn, r.Address, query, d.DebugLogger)
+	query := remoteNode.QueryMessage{T: t, Y: "q", Q: "ping", A: queryArguments}
+	d.sendQuery(r, query)
 	totalSentPing.Add(1)
 }
 
@@ -765,10 +1416,14 @@ func (d *DHT) getPeersFrom(r *remoteNode.RemoteNode, ih util.InfoHash) {
 		"id":        d.nodeId,
 		"info_hash": ih,
 	}
-	query := remoteNode.QueryMessage{transId, "q", ty, queryArguments}
+	query := remoteNode.QueryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
 	d.DebugLogger.Debugf("DHT sending get_peers. nodeID: %x@%v, InfoHash: %x , distance: %x", r.ID, r.Address, ih, util.HashDistance(util.InfoHash(r.ID), ih))
 	r.LastSearchTime = time.Now()
-	remoteNode.SendMsg(d.conn, r.Address, query, d.DebugLogger)
+	if l := d.announceLookup(ih); l != nil {
+		l.queried[r.Address.String()] = true
+		l.pending[r.Address.String()] = r.ID
+	}
+	d.sendQuery(r, query)
 }
 
 func (d *DHT) findNodeFrom(r *remoteNode.RemoteNode, id string) {
@@ -789,17 +1444,18 @@ func (d *DHT) findNodeFrom(r *remoteNode.RemoteNode, id string) {
 		"id":     d.nodeId,
 		"target": id,
 	}
-	query := remoteNode.QueryMessage{transId, "q", ty, queryArguments}
+	query := remoteNode.QueryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
 	d.DebugLogger.Debugf("DHT sending find_node. nodeID: %x@%v, target ID: %x , distance: %x", r.ID, r.Address, id, util.HashDistance(util.InfoHash(r.ID), ih))
 	r.LastSearchTime = time.Now()
-	remoteNode.SendMsg(d.conn, r.Address, query, d.DebugLogger)
+	d.sendQuery(r, query)
 }
 
 // announcePeer sends a message to the destination address to advertise that
 // our node is a peer for this infohash, using the provided token to
 // 'authenticate'.
-func (d *DHT) announcePeer(address net.UDPAddr, ih util.InfoHash, port int, token string) {
-	r, err := d.routingTable.GetOrCreateNode("", address.String(), d.config.UDPProto)
+// The port, implied_port and seed arguments are taken from options.
+func (d *DHT) announcePeer(address net.UDPAddr, ih util.InfoHash, options SearchOptions, token string) {
+	r, err := d.getOrCreateNode("", address.String(), remoteNode.SourceLookup)
 	if err != nil {
 		d.DebugLogger.Debugf("announcePeer error: %v", err)
 		return
@@ -807,30 +1463,27 @@ func (d *DHT) announcePeer(address net.UDPAddr, ih util.InfoHash, port int, toke
 	ty := "announce_peer"
 	d.DebugLogger.Debugf("DHT: announce_peer => address: %v, ih: %x, token: %x", address, ih, token)
 	transId := r.NewQuery(ty)
+	r.PendingQueries[transId].IH = ih
 	queryArguments := map[string]interface{}{
 		"id":        d.nodeId,
 		"info_hash": ih,
-		"port":      port,
+		"port":      options.Port,
 		"token":     token,
 	}
-	query := remoteNode.QueryMessage{transId, "q", ty, queryArguments}
-	remoteNode.SendMsg(d.conn, address, query, d.DebugLogger)
-}
-
-func (d *DHT) hostToken(addr net.UDPAddr, secret string) string {
-	h := sha1.New()
-	io.WriteString(h, addr.String())
-	io.WriteString(h, secret)
-	return fmt.Sprintf("%x", h.Sum(nil))
+	if options.ImpliedPort {
+		queryArguments["implied_port"] = 1
+	}
+	if options.Seed {
+		queryArguments["seed"] = 1
+	}
+	query := remoteNode.QueryMessage{T: transId, Y: "q", Q: ty, A: queryArguments}
+	d.sendQuery(r, query)
 }
 
-func (d *DHT) checkToken(addr net.UDPAddr, token string) bool {
-	match := false
-	for _, secret := range d.tokenSecrets {
-		if d.hostToken(addr, secret) == token {
-			match = true
-			break
-		}
+func (d *DHT) checkToken(addr net.UDPAddr, ih util.InfoHash, token string) bool {
+	match := d.tokens.Check(addr, ih, token)
+	if !match {
+		totalBadTokens.Add(1)
 	}
 	d.DebugLogger.Debugf("checkToken for %v, %q matches? %v", addr, token, match)
 	return match
@@ -838,13 +1491,40 @@ func (d *DHT) checkToken(addr net.UDPAddr, token string) bool {
 
 func (d *DHT) replyAnnouncePeer(addr net.UDPAddr, node *remoteNode.RemoteNode, r remoteNode.ResponseType) {
 	ih := util.InfoHash(r.A.InfoHash)
+	peerPort := r.A.Port
+	if r.A.ImpliedPort != 0 {
+		peerPort = addr.Port
+	}
 	d.DebugLogger.Debugf("DHT: announce_peer. Host %v, nodeID: %x, infoHash: %x, peerPort %d, distance to me %x",
-		addr, r.A.Id, ih, r.A.Port, util.HashDistance(ih, util.InfoHash(d.nodeId)),
+		addr, r.A.Id, ih, peerPort, util.HashDistance(ih, util.InfoHash(d.nodeId)),
 	)
+	validToken := d.checkToken(addr, ih, r.A.Token)
+	d.recordInfoHash(InfoHashEvent{
+		Type:       "announce_peer",
+		InfoHash:   ih,
+		NodeID:     r.A.Id,
+		Addr:       addr,
+		Port:       peerPort,
+		ValidToken: validToken,
+		Time:       time.Now(),
+	})
 	// node can be nil if, for example, the server just restarted and received an announce_peer
 	// from a node it doesn't yet know about.
-	if node != nil && d.checkToken(addr, r.A.Token) {
-		peerAddr := net.TCPAddr{IP: addr.IP, Port: r.A.Port}
+	if !validToken && d.Hooks != nil {
+		d.Hooks.TokenFailed(TokenEvent{Addr: addr, NodeID: r.A.Id, InfoHash: ih, Token: r.A.Token})
+	}
+	accepted := node != nil && validToken
+	if accepted {
+		if reason := d.announceRejection(addr.IP, ih, peerPort); reason != "" {
+			d.DebugLogger.Debugf("DHT: rejected announce_peer from %v for %x: %v", addr, ih, reason)
+			accepted = false
+		}
+	}
+	if accepted {
+		if l, ok := d.Logger.(AnnounceLogger); ok {
+			l.AnnouncePeer(addr, r.A.Id, ih, peerPort)
+		}
+		peerAddr := net.TCPAddr{IP: addr.IP, Port: peerPort}
 		d.peerStore.AddContact(ih, util.DottedPortToBinary(peerAddr.String()))
 		// Allow searching this node immediately, since it's telling us
 		// it has an infohash. Enables faster upgrade of other nodes to
@@ -852,16 +1532,21 @@ func (d *DHT) replyAnnouncePeer(addr net.UDPAddr, node *remoteNode.RemoteNode, r
 		node.LastResponseTime = time.Now().Add(-remoteNode.SearchRetryPeriod)
 		port := d.peerStore.HasLocalDownload(ih)
 		if port != 0 {
-			d.PeersRequestResults <- map[util.InfoHash][]string{ih: {util.DottedPortToBinary(peerAddr.String())}}
+			select {
+			case d.PeersRequestResults <- map[util.InfoHash][]string{ih: {util.DottedPortToBinary(peerAddr.String())}}:
+			case <-d.stop:
+				// Like in reportPeers, drop the result if we're closing
+				// down and the caller stopped reading.
+			}
 		}
 	}
 	// Always reply positively. jech says this is to avoid "back-tracking", not sure what that means.
 	reply := remoteNode.ReplyMessage{
 		T: r.T,
 		Y: "r",
-		R: map[string]interface{}{"id": d.nodeId},
+		R: map[string]interface{}{"id": d.replyID(string(ih))},
 	}
-	remoteNode.SendMsg(d.conn, addr, reply, d.DebugLogger)
+	d.sendReply(addr, "announce_peer", reply)
 }
 
 func (d *DHT) replyGetPeers(addr net.UDPAddr, r remoteNode.ResponseType) {
@@ -872,21 +1557,32 @@ func (d *DHT) replyGetPeers(addr net.UDPAddr, r remoteNode.ResponseType) {
 	if d.Logger != nil {
 		d.Logger.GetPeers(addr, r.A.Id, r.A.InfoHash)
 	}
+	d.recordInfoHash(InfoHashEvent{
+		Type:     "get_peers",
+		InfoHash: r.A.InfoHash,
+		NodeID:   r.A.Id,
+		Addr:     addr,
+		Time:     time.Now(),
+	})
 
 	ih := r.A.InfoHash
-	r0 := map[string]interface{}{"id": d.nodeId, "token": d.hostToken(addr, d.tokenSecrets[0])}
+	r0 := map[string]interface{}{"id": d.replyID(string(ih)), "token": d.tokens.Token(addr, ih)}
 	reply := remoteNode.ReplyMessage{
 		T: r.T,
 		Y: "r",
 		R: r0,
 	}
 
-	if peerContacts := d.peersForInfoHash(ih); len(peerContacts) > 0 {
+	if peerContacts := d.peersForInfoHash(ih, addr); len(peerContacts) > 0 {
 		reply.R["values"] = peerContacts
+		if d.config.Supernode {
+			// Help the querying node continue its search too.
+			reply.R["nodes"] = d.nodesForInfoHash(ih)
+		}
 	} else {
 		reply.R["nodes"] = d.nodesForInfoHash(ih)
 	}
-	remoteNode.SendMsg(d.conn, addr, reply, d.DebugLogger)
+	d.sendReply(addr, "get_peers", reply)
 }
 
 func (d *DHT) nodesForInfoHash(ih util.InfoHash) string {
@@ -907,8 +1603,15 @@ func (d *DHT) nodesForInfoHash(ih util.InfoHash) string {
 	return strings.Join(n, "")
 }
 
-func (d *DHT) peersForInfoHash(ih util.InfoHash) []string {
-	peerContacts := d.peerStore.PeerContacts(ih)
+// peersForInfoHash returns peers for ih of the address family that the
+// requester at addr can use.
+func (d *DHT) peersForInfoHash(ih util.InfoHash, addr net.UDPAddr) []string {
+	var peerContacts []string
+	if addr.IP.To4() != nil {
+		peerContacts = d.peerStore.PeerContacts(ih)
+	} else {
+		peerContacts = d.peerStore.PeerContacts6(ih)
+	}
 	if len(peerContacts) > 0 {
 		d.DebugLogger.Debugf("replyGetPeers: Giving peers! %x was requested, and we knew %d peers!", ih, len(peerContacts))
 	}
@@ -921,7 +1624,7 @@ func (d *DHT) replyFindNode(addr net.UDPAddr, r remoteNode.ResponseType) {
 		addr, r.A.Id, r.A.Target, util.HashDistance(util.InfoHash(r.A.Target), util.InfoHash(d.nodeId)))
 
 	node := util.InfoHash(r.A.Target)
-	r0 := map[string]interface{}{"id": d.nodeId}
+	r0 := map[string]interface{}{"id": d.replyID(r.A.Target)}
 	reply := remoteNode.ReplyMessage{
 		T: r.T,
 		Y: "r",
@@ -941,7 +1644,7 @@ func (d *DHT) replyFindNode(addr net.UDPAddr, r remoteNode.ResponseType) {
 	}
 	d.DebugLogger.Debugf("replyFindNode: Nodes only. Giving %d", len(n))
 	reply.R["nodes"] = strings.Join(n, "")
-	remoteNode.SendMsg(d.conn, addr, reply, d.DebugLogger)
+	d.sendReply(addr, "find_node", reply)
 }
 
 func (d *DHT) replyPing(addr net.UDPAddr, response remoteNode.ResponseType) {
@@ -951,42 +1654,29 @@ func (d *DHT) replyPing(addr net.UDPAddr, response remoteNode.ResponseType) {
 		Y: "r",
 		R: map[string]interface{}{"id": d.nodeId},
 	}
-	remoteNode.SendMsg(d.conn, addr, reply, d.DebugLogger)
+	d.sendReply(addr, "ping", reply)
 }
 
 // Process another node's response to a get_peers query. If the response
 // contains peers, send them to the Torrent engine, our client, using the
 // DHT.PeersRequestResults channel. If it contains closest nodes, query
-// them if we still need it. Also announce ourselves as a peer for that node,
-// unless we are in supernode mode.
+// them if we still need it, or if they can take part in an announce lookup.
+// If that lookup converged, announce ourselves to the closest nodes it found.
 func (d *DHT) processGetPeerResults(node *remoteNode.RemoteNode, resp remoteNode.ResponseType) {
 	totalRecvGetPeersReply.Add(1)
 
 	query, _ := node.PendingQueries[resp.T]
-	port := d.peerStore.HasLocalDownload(query.IH)
-	if port != 0 {
-		d.announcePeer(node.Address, query.IH, port, resp.R.Token)
+	// We don't announce to every node that replies, only to the closest
+	// ones found by an announce lookup, once it's over.
+	l := d.announceLookup(query.IH)
+	if l != nil {
+		delete(l.pending, node.Address.String())
+		if resp.R.Token != "" {
+			l.responders[node.Address.String()] = announceResponder{node.ID, node.Address, resp.R.Token}
+		}
 	}
 	if resp.R.Values != nil {
-		peers := make([]string, 0)
-		for _, peerContact := range resp.R.Values {
-			// send peer even if we already have it in store
-			// the underlying client does/should handle dupes
-			d.peerStore.AddContact(query.IH, peerContact)
-			peers = append(peers, peerContact)
-		}
-		if len(peers) > 0 {
-			// Finally, new peers.
-			result := map[util.InfoHash][]string{query.IH: peers}
-			totalPeers.Add(int64(len(peers)))
-			d.DebugLogger.Debugf("DHT: processGetPeerResults, totalPeers: %v", totalPeers.String())
-			select {
-			case d.PeersRequestResults <- result:
-			case <-d.stop:
-				// if we're closing down and the caller has stopped reading
-				// from PeersRequestResults, drop the result.
-			}
-		}
+		d.reportPeers(query.IH, d.validatePeers(query.IH, node.Address, resp.R.Values))
 	}
 	var nodelist string
 
@@ -1003,8 +1693,9 @@ func (d *DHT) processGetPeerResults(node *remoteNode.RemoteNode, resp remoteNode
 				continue
 			}
 
-			// If it's in our routing table already, ignore it.
-			_, addr, existed, err := d.routingTable.HostPortToNode(address, d.config.UDPProto)
+			// If it's in our routing table already, ignore it, unless
+			// a scheduled announce lookup should follow it.
+			n, addr, existed, err := d.routingTable.HostPortToNode(address, d.config.UDPProto)
 			if err != nil {
 				d.DebugLogger.Debugf("DHT error parsing get peers node: %v", err)
 				continue
@@ -1021,11 +1712,18 @@ func (d *DHT) processGetPeerResults(node *remoteNode.RemoteNode, resp remoteNode
 				d.DebugLogger.Debugf("DHT: processGetPeerResults DUPE node reference: %x@%v from %x@%v. Distance: %x.",
 					id, address, node.ID, node.Address, util.HashDistance(query.IH, util.InfoHash(node.ID)))
 				totalGetPeersDupes.Add(1)
+				if l != nil {
+					d.followLookup(l, query.IH, n)
+				}
 			} else {
 				// And it is actually new. Interesting.
 				d.DebugLogger.Debugf("DHT: Got new node reference: %x@%v from %x@%v. Distance: %x.",
 					id, address, node.ID, node.Address, util.HashDistance(query.IH, util.InfoHash(node.ID)))
-				if _, err := d.routingTable.GetOrCreateNode(id, addr, d.config.UDPProto); err == nil && d.needMorePeers(query.IH) {
+				n, err := d.getOrCreateNode(id, addr, remoteNode.SourceLookup)
+				if err == nil && l != nil {
+					d.followLookup(l, query.IH, n)
+				}
+				if err == nil && d.needMorePeers(query.IH) {
 					// Re-add this request to the queue. This would in theory
 					// batch similar requests, because new nodes are already
 					// available in the routing table and will be used at the
@@ -1037,8 +1735,7 @@ func (d *DHT) processGetPeerResults(node *remoteNode.RemoteNode, resp remoteNode
 					// needed here: if this node is downloading that particular
 					// infohash, that has already been recorded with
 					// peerStore.addLocalDownload(). The announcement itself is
-					// sent not when get_peers is sent, but when processing the
-					// reply to get_peers.
+					// sent when an announce lookup is over, see announce.go.
 					//
 					select {
 					case d.peersRequest <- ihReq{ih: query.IH}:
@@ -1052,6 +1749,9 @@ func (d *DHT) processGetPeerResults(node *remoteNode.RemoteNode, resp remoteNode
 			}
 		}
 	}
+	if l != nil && l.converged(query.IH) {
+		d.finishAnnounce(query.IH, d.announces[query.IH], time.Now())
+	}
 }
 
 // Process another node's response to a find_node query.
@@ -1094,7 +1794,7 @@ func (d *DHT) processFindNodeResults(node *remoteNode.RemoteNode, resp remoteNod
 				// Includes the node in the routing table and ignores errors.
 				//
 				// Only continue the search if we really have to.
-				r, err := d.routingTable.GetOrCreateNode(id, addr, d.config.UDPProto)
+				r, err := d.getOrCreateNode(id, addr, remoteNode.SourceLookup)
 				if err != nil {
 					d.DebugLogger.Debugf("processFindNodeResults calling getOrCreateNode: %v. Id=%x, Address=%q", err, id, addr)
 					continue
@@ -1132,4 +1832,15 @@ var (
 	totalPacketsFromBlockedHosts = expvar.NewInt("totalPacketsFromBlockedHosts")
 	totalDroppedPackets          = expvar.NewInt("totalDroppedPackets")
 	totalRecv                    = expvar.NewInt("totalRecv")
+	totalBadTokens               = expvar.NewInt("totalBadTokens")
+	totalSpiderEvents            = expvar.NewInt("totalSpiderEvents")
+	totalCrawls                  = expvar.NewInt("totalCrawls")
+	totalVerifiedReplacements    = expvar.NewInt("totalVerifiedReplacements")
+	totalRegionRefreshes         = expvar.NewInt("totalRegionRefreshes")
+	totalAnnounceLookups         = expvar.NewInt("totalAnnounceLookups")
+	totalTimedOutQueries         = expvar.NewInt("totalTimedOutQueries")
+	// Estimated memory used, in bytes, see updateMemory.
+	routingTableMemory   = expvar.NewInt("routingTableMemory")
+	peerStoreMemory      = expvar.NewInt("peerStoreMemory")
+	totalFailedAnnounces = expvar.NewInt("totalFailedAnnounces")
 )
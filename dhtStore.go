@@ -10,14 +10,20 @@ import (
 	"strings"
 )
 
-// dhtStore is used to persist the routing table on disk.
+// dhtStore is used to persist the routing table and the local downloads on
+// disk.
 type dhtStore struct {
 	// The rest of the stack uses string, but that confuses the json
 	// Marshaller. []byte is more correct anyway.
 	Id      []byte
 	Port    int
 	Remotes map[string][]byte // Key: IP, Value: node ID.
-	path    string            // Empty if the store is disabled.
+	// Infohashes we are downloading, to announce them again after a
+	// restart. Key: hex infohash, Value: port.
+	Downloads map[string]int
+	// Search options of the downloads. Key: hex infohash.
+	Searches map[string]SearchOptions
+	path     string // Empty if the store is disabled.
 }
 
 // mkdirStore() creates a directory to load and save the configuration from.
@@ -17,6 +17,9 @@ import (
 // 16 bytes.
 const ffff = "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"
 
+// Infohash used by the tests, d1c5676ae7ac98e8b19f63565905105e3c4c37a2 in hex.
+const testInfoHash util.InfoHash = "\xd1\xc5\x67\x6a\xe7\xac\x98\xe8\xb1\x9f\x63\x56\x59\x05\x10\x5e\x3c\x4c\x37\xa2"
+
 func BenchmarkFindClosest(b *testing.B) {
 	b.StopTimer()
 	cfg := NewConfig()
@@ -123,6 +126,9 @@ func startNode(routers string, ih string) (*DHT, error) {
 	c.SaveRoutingTable = false
 	c.DHTRouters = routers
 	c.Port = 0
+	c.ExemptLoopbackNodes = true
+	// All the nodes talk from the same host, don't throttle them.
+	c.ThrottlerAllowlist = "127.0.0.0/8"
 	node, err := New(c)
 	if err != nil {
 		return nil, err
@@ -136,9 +142,29 @@ func startNode(routers string, ih string) (*DHT, error) {
 	return node, nil
 }
 
+// newTestDHT creates a DHT that doesn't save its routing table nor contact
+// the bootstrap routers. configure, if not nil, can change the config first.
+func newTestDHT(t *testing.T, configure func(*Config)) *DHT {
+	t.Helper()
+	c := NewConfig()
+	c.SaveRoutingTable = false
+	c.DHTRouters = ""
+	if configure != nil {
+		configure(c)
+	}
+	d, err := New(c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d
+}
+
 // drainResults loops until the target number of peers are found, or a time limit is reached.
 func drainResults(n *DHT, ih string, targetCount int, timeout time.Duration) error {
 	count := 0
+	deadline := time.After(timeout)
+	retry := time.NewTicker(time.Second / 5)
+	defer retry.Stop()
 	for {
 		select {
 		case r := <-n.PeersRequestResults:
@@ -151,10 +177,10 @@ func drainResults(n *DHT, ih string, targetCount int, timeout time.Duration) err
 					}
 				}
 			}
-		case <-time.Tick(timeout):
+		case <-deadline:
 			return fmt.Errorf("drainResult timed out")
 
-		case <-time.Tick(time.Second / 5):
+		case <-retry.C:
 			n.PeersRequest(ih, true)
 		}
 	}
@@ -176,6 +202,19 @@ func TestDHTLocal(t *testing.T) {
 		return
 	}
 
+	// n1 is only a router. Nobody waits for its results, so discard them
+	// to keep its loop from blocking on PeersRequestResults.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-n1.PeersRequestResults:
+			case <-done:
+				return
+			}
+		}
+	}()
 	router := fmt.Sprintf("localhost:%d", n1.Port())
 	n2, err := startNode(router, string(infoHash))
 	if err != nil {
@@ -336,3 +375,170 @@ func stats(t *testing.T) {
 	t.Logf("totalSentFindNode: %v", totalSentFindNode)
 	t.Logf("totalSentGetPeers: %v", totalSentGetPeers)
 }
+
+func TestRoutingTableType(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.RoutingTableType = "kbucket" })
+	n, err := d.routingTable.GetOrCreateNode(id, "1.2.3.4:1111", "udp4")
+	if err != nil {
+		t.Fatalf("GetOrCreateNode: %v", err)
+	}
+	if got := d.routingTable.Lookup(util.InfoHash(id)); len(got) != 1 || got[0] != n {
+		t.Fatalf("Lookup = %v, wanted the inserted node", got)
+	}
+
+	c := NewConfig()
+	c.RoutingTableType = "bogus"
+	if _, err := New(c); err == nil {
+		t.Fatalf("New accepted an unknown routing table type")
+	}
+}
+
+func TestADDHonestPeerConcurrent(t *testing.T) {
+	d := newTestDHT(t, nil)
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("127.0.0.1:%d", 10000+i)
+			if err := d.ADDHonestPeer(randNodeID(t), addr); err != nil {
+				t.Errorf("ADDHonestPeer(%v): %v", addr, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	n := 0
+	d.do(func() { n = d.routingTable.Length() })
+	if n != 10 {
+		t.Fatalf("routing table has %d nodes, wanted 10", n)
+	}
+}
+
+func TestHonestPeers(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.MaxNodes = 1 })
+	if _, err := d.getOrCreateNode(randNodeID(t), "10.0.0.1:1234", remoteNode.SourceLookup); err != nil {
+		t.Fatalf("getOrCreateNode: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	// Trusted nodes are not subject to MaxNodes.
+	if err := d.ADDHonestPeer(randNodeID(t), "10.0.1.1:1234"); err != nil {
+		t.Fatalf("ADDHonestPeer: %v", err)
+	}
+	// Known nodes can be promoted.
+	if err := d.ADDHonestPeer("", "10.0.0.1:1234"); err != nil {
+		t.Fatalf("ADDHonestPeer for a known node: %v", err)
+	}
+	peers := d.HonestPeers()
+	if len(peers) != 2 {
+		t.Fatalf("HonestPeers returned %d nodes, wanted 2", len(peers))
+	}
+	for _, p := range peers {
+		if !p.Honest {
+			t.Errorf("trusted node %v not marked as honest", p.Address)
+		}
+	}
+	if err := d.RemoveHonestPeer("10.0.1.1:1234"); err != nil {
+		t.Fatalf("RemoveHonestPeer: %v", err)
+	}
+	if err := d.RemoveHonestPeer("10.0.1.1:1234"); err == nil {
+		t.Fatalf("RemoveHonestPeer succeeded for a removed node")
+	}
+	if n := len(d.HonestPeers()); n != 1 {
+		t.Fatalf("HonestPeers returned %d nodes after removal, wanted 1", n)
+	}
+}
+
+func TestResumeDownloads(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ih := testInfoHash
+	c := NewConfig()
+	c.Port = 0
+	d, err := New(c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	d.peerStore.AddLocalDownload(ih, 6881)
+	d.setSearch(ih, SearchOptions{Announce: true, Port: 6881, Seed: true})
+	d.save()
+
+	d, err = New(c)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	if port := d.peerStore.HasLocalDownload(ih); port != 6881 {
+		t.Fatalf("local download port after restart = %d, wanted 6881", port)
+	}
+	if !d.searchOptions(ih).Seed {
+		t.Fatalf("search options not resumed: %+v", d.searchOptions(ih))
+	}
+
+	c.ResumeDownloads = false
+	d, err = New(c)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	if port := d.peerStore.HasLocalDownload(ih); port != 0 {
+		t.Fatalf("local download resumed with ResumeDownloads disabled")
+	}
+}
+
+func TestSaveDownloadsOnStop(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ih := testInfoHash
+	c := NewConfig()
+	c.Port = 0
+	c.DHTRouters = ""
+	d, err := New(c)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err = d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	d.PeersRequestPort(string(ih), true, 6881)
+	dirty := false
+	for deadline := time.Now().Add(5 * time.Second); !dirty && time.Now().Before(deadline); {
+		d.do(func() { dirty = d.downloadsDirty })
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !dirty {
+		t.Fatalf("the new local download wasn't marked for saving")
+	}
+	d.Stop()
+
+	d, err = New(c)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	if port := d.peerStore.HasLocalDownload(ih); port != 6881 {
+		t.Fatalf("local download port after restart = %d, wanted 6881", port)
+	}
+}
+
+func TestSearchOptions(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.NumTargetPeers = 2 })
+	ih := util.InfoHash(randNodeID(t))
+	d.peerStore.AddContact(ih, "abcdef")
+	if !d.needMorePeers(ih) {
+		t.Errorf("needMorePeers is false with 1 peer, default target 2")
+	}
+	d.setSearch(ih, SearchOptions{TargetPeers: 1})
+	if d.needMorePeers(ih) {
+		t.Errorf("needMorePeers is true with 1 peer, target 1")
+	}
+	d.setSearch(ih, SearchOptions{TargetPeers: 10, LookupDeadline: time.Minute})
+	if !d.needMorePeers(ih) {
+		t.Errorf("needMorePeers is false with 1 peer, target 10")
+	}
+	d.searches[ih].started = time.Now().Add(-time.Hour)
+	if d.needMorePeers(ih) {
+		t.Errorf("needMorePeers is true after the deadline")
+	}
+}
@@ -5,5 +5,7 @@ go 1.19
 require (
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da
 	github.com/jackpal/bencode-go v1.0.0
-	vitess.io/vitess v0.16.0
+	go.etcd.io/bbolt v1.3.8
 )
+
+require golang.org/x/sys v0.10.0 // indirect
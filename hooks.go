@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"net"
+
+	"dht/peer"
+	"dht/remoteNode"
+	"dht/routingTable"
+	"dht/util"
+)
+
+// Hooks receives structured events for the RPCs handled by the DHT and the
+// changes to its routing table and peer store, which is useful for auditing.
+// Embed NopHooks to implement only the methods you care about.
+//
+// Hooks are called synchronously from the DHT main loop, so they should not
+// block for long. For the same reason, they must not call the DHT methods
+// that are documented as safe to call from any goroutine, like Nodes,
+// MemoryStats or AnnounceStatus: those wait for the main loop, which would
+// deadlock. Call them from another goroutine instead.
+type Hooks interface {
+	routingTable.Hooks
+	peer.Hooks
+	// QueryReceived is called for every query received, before it's
+	// handled.
+	QueryReceived(e QueryEvent)
+	// QuerySent is called for every query sent.
+	QuerySent(e QueryEvent)
+	// ReplyReceived is called for every reply to one of our queries.
+	ReplyReceived(e ReplyEvent)
+	// ReplySent is called for every reply sent.
+	ReplySent(e ReplyEvent)
+	// TokenFailed is called when an announce_peer query has an invalid
+	// token.
+	TokenFailed(e TokenEvent)
+	// ThrottleBlocked is called when a packet is dropped because its source
+	// host is blocked by the client throttler.
+	ThrottleBlocked(e ThrottleEvent)
+}
+
+// QueryEvent is a KRPC query, sent or received.
+type QueryEvent struct {
+	// Query type: "ping", "find_node", "get_peers" or "announce_peer".
+	Type          string
+	TransactionID string
+	// Address of the remote node.
+	Addr net.UDPAddr
+	// ID of the remote node, if known.
+	NodeID string
+	// get_peers and announce_peer only.
+	InfoHash util.InfoHash
+	// find_node only.
+	Target string
+	// announce_peer only.
+	Port  int
+	Token string
+}
+
+// ReplyEvent is a KRPC reply, sent or received.
+type ReplyEvent struct {
+	// Type of the query being replied to.
+	Type          string
+	TransactionID string
+	// Address of the remote node.
+	Addr net.UDPAddr
+	// ID of the remote node for received replies, or the ID we replied
+	// with.
+	NodeID string
+	// get_peers only.
+	Token string
+	// Number of node contacts in the reply.
+	Nodes int
+	// Number of peer contacts in the reply.
+	Values int
+}
+
+// TokenEvent is an announce_peer query with an invalid token.
+type TokenEvent struct {
+	Addr     net.UDPAddr
+	NodeID   string
+	InfoHash util.InfoHash
+	Token    string
+}
+
+// ThrottleEvent is a packet dropped by the client throttler.
+type ThrottleEvent struct {
+	Addr net.UDPAddr
+}
+
+// NopHooks implements Hooks doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) NodeAdded(e routingTable.NodeEvent)   {}
+func (NopHooks) NodeRemoved(e routingTable.NodeEvent) {}
+func (NopHooks) NodeEvicted(e routingTable.NodeEvent) {}
+func (NopHooks) PeerStored(e peer.PeerEvent)          {}
+func (NopHooks) PeerDropped(e peer.PeerEvent)         {}
+func (NopHooks) QueryReceived(e QueryEvent)           {}
+func (NopHooks) QuerySent(e QueryEvent)               {}
+func (NopHooks) ReplyReceived(e ReplyEvent)           {}
+func (NopHooks) ReplySent(e ReplyEvent)               {}
+func (NopHooks) TokenFailed(e TokenEvent)             {}
+func (NopHooks) ThrottleBlocked(e ThrottleEvent)      {}
+
+// hooks forwards routing table and peer store events to DHT.Hooks, which can
+// be set after the DHT is created.
+type hooks struct {
+	d *DHT
+}
+
+func (h hooks) NodeAdded(e routingTable.NodeEvent) {
+	if h.d.Hooks != nil {
+		h.d.Hooks.NodeAdded(e)
+	}
+}
+
+func (h hooks) NodeRemoved(e routingTable.NodeEvent) {
+	if h.d.Hooks != nil {
+		h.d.Hooks.NodeRemoved(e)
+	}
+}
+
+func (h hooks) NodeEvicted(e routingTable.NodeEvent) {
+	if h.d.Hooks != nil {
+		h.d.Hooks.NodeEvicted(e)
+	}
+}
+
+func (h hooks) PeerStored(e peer.PeerEvent) {
+	if h.d.Hooks != nil {
+		h.d.Hooks.PeerStored(e)
+	}
+}
+
+func (h hooks) PeerDropped(e peer.PeerEvent) {
+	if h.d.Hooks != nil {
+		h.d.Hooks.PeerDropped(e)
+	}
+}
+
+// queryEvent builds a QueryEvent from a query message.
+func queryEvent(addr net.UDPAddr, nodeID string, q remoteNode.QueryMessage) QueryEvent {
+	e := QueryEvent{Type: q.Q, TransactionID: q.T, Addr: addr, NodeID: nodeID}
+	e.InfoHash, _ = q.A["info_hash"].(util.InfoHash)
+	e.Target, _ = q.A["target"].(string)
+	e.Port, _ = q.A["port"].(int)
+	e.Token, _ = q.A["token"].(string)
+	return e
+}
+
+// sendQuery sends a query to r and notifies the hooks.
+func (d *DHT) sendQuery(r *remoteNode.RemoteNode, query remoteNode.QueryMessage) {
+	remoteNode.SendMsg(d.conn, r.Address, query, d.DebugLogger)
+	if d.Hooks != nil {
+		d.Hooks.QuerySent(queryEvent(r.Address, r.ID, query))
+	}
+}
+
+// sendReply sends a reply to a query of type queryType and notifies the
+// hooks.
+func (d *DHT) sendReply(addr net.UDPAddr, queryType string, reply remoteNode.ReplyMessage) {
+	remoteNode.SendMsg(d.conn, addr, reply, d.DebugLogger)
+	if d.Hooks != nil {
+		e := ReplyEvent{Type: queryType, TransactionID: reply.T, Addr: addr}
+		e.NodeID, _ = reply.R["id"].(string)
+		e.Token, _ = reply.R["token"].(string)
+		if nodes, ok := reply.R["nodes"].(string); ok {
+			e.Nodes = len(nodes) / d.nodeContactLen()
+		}
+		if values, ok := reply.R["values"].([]string); ok {
+			e.Values = len(values)
+		}
+		d.Hooks.ReplySent(e)
+	}
+}
+
+func (d *DHT) nodeContactLen() int {
+	if d.config.UDPProto == "udp6" {
+		return remoteNode.V6nodeContactLen
+	}
+	return remoteNode.V4nodeContactLen
+}
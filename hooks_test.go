@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"dht/peer"
+	"dht/routingTable"
+	"dht/util"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+type recordingHooks struct {
+	NopHooks
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(e string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+}
+
+func (h *recordingHooks) has(e string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, x := range h.events {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *recordingHooks) NodeAdded(e routingTable.NodeEvent)   { h.record("NodeAdded") }
+func (h *recordingHooks) NodeRemoved(e routingTable.NodeEvent) { h.record("NodeRemoved " + e.Reason) }
+func (h *recordingHooks) PeerStored(e peer.PeerEvent)          { h.record("PeerStored") }
+func (h *recordingHooks) QueryReceived(e QueryEvent)           { h.record("QueryReceived " + e.Type) }
+func (h *recordingHooks) ReplySent(e ReplyEvent)               { h.record("ReplySent " + e.Type) }
+
+func TestHooks(t *testing.T) {
+	d := newTestDHT(t, nil)
+	h := &recordingHooks{}
+	d.Hooks = h
+
+	n, err := d.routingTable.GetOrCreateNode(id, "1.2.3.4:1111", "udp4")
+	if err != nil {
+		t.Fatalf("GetOrCreateNode: %v", err)
+	}
+	d.routingTable.Kill(n, d.peerStore)
+	d.peerStore.AddContact(util.InfoHash(id), "abcdef")
+	for _, e := range []string{"NodeAdded", "NodeRemoved " + routingTable.ReasonKilled, "PeerStored"} {
+		if !h.has(e) {
+			t.Errorf("missing event %q, got %v", e, h.events)
+		}
+	}
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	var b bytes.Buffer
+	bencode.Marshal(&b, map[string]interface{}{"t": "aa", "y": "q", "q": "ping", "a": map[string]interface{}{"id": "abcdefghij0123456789"}})
+	if _, err := conn.WriteToUDP(b.Bytes(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: d.Port()}); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadFromUDP(make([]byte, 1024)); err != nil {
+		t.Fatalf("no reply to ping: %v", err)
+	}
+	// ReplySent is called right after the reply is sent, so give it a moment.
+	time.Sleep(10 * time.Millisecond)
+	for _, e := range []string{"QueryReceived ping", "ReplySent ping"} {
+		if !h.has(e) {
+			t.Errorf("missing event %q, got %v", e, h.events)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"dht/remoteNode"
+	"dht/routingTable"
+	"dht/util"
+)
+
+// NodeInfo is a snapshot of a node in the routing table.
+type NodeInfo struct {
+	ID        util.InfoHash
+	Address   string
+	Reachable bool
+	// BEP 5 state: "good", "questionable" or "bad".
+	State string
+	// Last time the node replied to or queried us.
+	LastSeen time.Time
+	// Smoothed round-trip time, zero if the node never replied.
+	RTT      time.Duration
+	Replies  int
+	Failures int
+	// How we learned about the node, one of the remoteNode.Source*
+	// constants.
+	Source string
+	Honest bool
+}
+
+func newNodeInfo(n *remoteNode.RemoteNode) NodeInfo {
+	seen := n.LastResponseTime
+	if n.LastQueryTime.After(seen) {
+		seen = n.LastQueryTime
+	}
+	return NodeInfo{
+		ID:        util.InfoHash(n.ID),
+		Address:   n.Address.String(),
+		Reachable: n.Reachable,
+		State:     n.State().String(),
+		LastSeen:  seen,
+		RTT:       n.SRTT,
+		Replies:   n.Replies,
+		Failures:  n.Failures,
+		Source:    n.Source,
+		Honest:    n.Honest,
+	}
+}
+
+// RoutingStats summarizes the shape of the routing table.
+type RoutingStats struct {
+	// Number of nodes in the table, and how many of them are reachable.
+	Nodes     int
+	Reachable int
+	// Depth[i] is the number of nodes that share exactly i prefix bits with
+	// our ID. Nodes with unknown IDs are not counted.
+	Depth []int
+	// The most distant node of our neighborhood, if any, and how many
+	// prefix bits it shares with our ID.
+	Boundary  *NodeInfo
+	Proximity int
+}
+
+// Nodes returns a snapshot of the nodes in the routing table, in no
+// particular order. It is safe to call from any goroutine.
+func (d *DHT) Nodes() (nodes []NodeInfo) {
+	d.do(func() {
+		d.routingTable.Each(func(n *remoteNode.RemoteNode) bool {
+			nodes = append(nodes, newNodeInfo(n))
+			return true
+		})
+	})
+	return nodes
+}
+
+// RoutingStats returns statistics about the routing table. It is safe to call
+// from any goroutine.
+func (d *DHT) RoutingStats() (s RoutingStats) {
+	d.do(func() {
+		d.routingTable.Each(func(n *remoteNode.RemoteNode) bool {
+			s.Nodes++
+			if n.Reachable {
+				s.Reachable++
+			}
+			if len(n.ID) == len(d.nodeId) && n.ID != d.nodeId {
+				depth := routingTable.CommonBits(d.nodeId, n.ID)
+				for len(s.Depth) <= depth {
+					s.Depth = append(s.Depth, 0)
+				}
+				s.Depth[depth]++
+			}
+			return true
+		})
+		boundary, proximity := d.routingTable.Neighborhood()
+		if boundary != nil {
+			b := newNodeInfo(boundary)
+			s.Boundary = &b
+		}
+		s.Proximity = proximity
+	})
+	return s
+}
+
+// Closest returns up to n nodes from the routing table with known IDs,
+// closest to target first, or nil if n isn't positive. Unlike the lookups
+// done by the DHT, it doesn't skip nodes that are busy or unreachable. It is
+// safe to call from any goroutine.
+func (d *DHT) Closest(target util.InfoHash, n int) []NodeInfo {
+	if n <= 0 {
+		return nil
+	}
+	var found []*remoteNode.RemoteNode
+	var nodes []NodeInfo
+	d.do(func() {
+		d.routingTable.Each(func(r *remoteNode.RemoteNode) bool {
+			if len(r.ID) == len(target) {
+				found = append(found, r)
+			}
+			return true
+		})
+		sort.Slice(found, func(i, j int) bool {
+			return util.HashDistance(target, util.InfoHash(found[i].ID)) <
+				util.HashDistance(target, util.InfoHash(found[j].ID))
+		})
+		if len(found) > n {
+			found = found[:n]
+		}
+		for _, r := range found {
+			nodes = append(nodes, newNodeInfo(r))
+		}
+	})
+	return nodes
+}
+
+// MemoryStats reports the estimated memory used by the DHT, in bytes.
+type MemoryStats struct {
+	RoutingTable int64
+	PeerStore    int64
+	// Config.MemoryBudget, zero if unlimited.
+	Budget int64
+}
+
+// MemoryStats estimates the memory used by the routing table and the peer
+// store. It is safe to call from any goroutine.
+func (d *DHT) MemoryStats() (s MemoryStats) {
+	d.do(func() {
+		s.RoutingTable = d.routingTable.MemoryUsage()
+	})
+	s.PeerStore = d.peerStore.MemoryUsage()
+	s.Budget = d.config.MemoryBudget
+	return s
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+func TestInspection(t *testing.T) {
+	d := newTestDHT(t, nil)
+	for i := 0; i < 20; i++ {
+		n, err := d.getOrCreateNode(randNodeID(t), fmt.Sprintf("10.0.%d.1:1234", i), remoteNode.SourceLookup)
+		if err != nil {
+			t.Fatalf("getOrCreateNode: %v", err)
+		}
+		if i%2 == 0 {
+			n.Reachable = true
+		}
+	}
+
+	nodes := d.Nodes()
+	if len(nodes) != 20 {
+		t.Fatalf("Nodes returned %d nodes, wanted 20", len(nodes))
+	}
+	for _, n := range nodes {
+		if n.Source != remoteNode.SourceLookup {
+			t.Errorf("node %v has source %q, wanted %q", n.Address, n.Source, remoteNode.SourceLookup)
+		}
+	}
+
+	s := d.RoutingStats()
+	if s.Nodes != 20 || s.Reachable != 10 {
+		t.Errorf("RoutingStats has %d nodes, %d reachable, wanted 20 and 10", s.Nodes, s.Reachable)
+	}
+	total := 0
+	for _, n := range s.Depth {
+		total += n
+	}
+	if total != 20 {
+		t.Errorf("RoutingStats.Depth counts %d nodes, wanted 20", total)
+	}
+
+	target := util.InfoHash(randNodeID(t))
+	closest := d.Closest(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("Closest returned %d nodes, wanted 5", len(closest))
+	}
+	for i := 1; i < len(closest); i++ {
+		if util.HashDistance(target, closest[i-1].ID) > util.HashDistance(target, closest[i].ID) {
+			t.Fatalf("Closest results are not sorted by distance")
+		}
+	}
+	for _, n := range nodes {
+		if util.HashDistance(target, n.ID) < util.HashDistance(target, closest[0].ID) {
+			t.Fatalf("Closest missed node %x", n.ID)
+		}
+	}
+	for _, n := range []int{0, -1} {
+		if closest := d.Closest(target, n); closest != nil {
+			t.Errorf("Closest(%d) returned %d nodes, wanted nil", n, len(closest))
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	d := newTestDHT(t, func(c *Config) { c.MemoryBudget = 1 << 20 })
+	for i := 0; i < 10; i++ {
+		if _, err := d.getOrCreateNode(randNodeID(t), fmt.Sprintf("10.0.%d.1:1234", i), remoteNode.SourceLookup); err != nil {
+			t.Fatalf("getOrCreateNode: %v", err)
+		}
+	}
+	d.peerStore.AddContact(util.InfoHash(randNodeID(t)), "abcdef")
+	d.updateMemory()
+	s := d.MemoryStats()
+	if s.RoutingTable == 0 || s.PeerStore == 0 || s.Budget != 1<<20 {
+		t.Fatalf("unexpected memory stats %+v", s)
+	}
+
+	// Nodes are counted as they're added, without waiting for
+	// updateMemory: there is room for one more.
+	d.config.MemoryBudget = 2*s.RoutingTable + 2
+	if _, err := d.getOrCreateNode(randNodeID(t), "10.0.99.1:1234", remoteNode.SourceLookup); err != nil {
+		t.Fatalf("getOrCreateNode: %v", err)
+	}
+
+	// Once the routing table used half the budget, new nodes are only kept
+	// as replacement candidates.
+	if d.roomForNodes() {
+		t.Errorf("roomForNodes is true with the routing table memory full")
+	}
+	if _, err := d.getOrCreateNode(randNodeID(t), "10.0.100.1:1234", remoteNode.SourceLookup); err == nil {
+		t.Errorf("getOrCreateNode added a node with the routing table memory full")
+	}
+	if d.routingTable.Replacement("10.0.100.1:1234") == nil {
+		t.Errorf("the refused node is not a replacement candidate")
+	}
+	if _, err := d.getOrCreateNode("", "10.0.1.1:1234", remoteNode.SourceLookup); err != nil {
+		t.Errorf("getOrCreateNode failed for a known node: %v", err)
+	}
+	if _, err := d.getOrCreateNode("", "10.0.101.1:6881", remoteNode.SourceRouter); err != nil {
+		t.Errorf("getOrCreateNode refused a bootstrap router: %v", err)
+	}
+}
@@ -60,7 +60,7 @@ func TestUpkeep(t *testing.T) {
 			t.Fatal(err)
 		}
 		n[0] = byte(0x3d) // Ensure long distance.
-		r.NeighborhoodUpkeep(genremoteNode(string(n)), "udp", peer.NewPeerStore(0, 0))
+		r.NeighborhoodUpkeep(genremoteNode(string(n)), "udp", peer.NewMemoryPeerStore(0, 0))
 	}
 
 	// Current state: 8 neighbors with low proximity.
@@ -68,7 +68,7 @@ func TestUpkeep(t *testing.T) {
 	// Adds 7 neighbors from the static table. They should replace the
 	// random ones, except for one.
 	for _, v := range table[1:8] {
-		r.NeighborhoodUpkeep(genremoteNode(v.rid), "udp", peer.NewPeerStore(0, 0))
+		r.NeighborhoodUpkeep(genremoteNode(v.rid), "udp", peer.NewMemoryPeerStore(0, 0))
 	}
 
 	// Current state: 7 close neighbors, one distant dude.
@@ -89,7 +89,7 @@ func TestUpkeep(t *testing.T) {
 	if r.BoundaryNode == nil {
 		t.Fatalf("tried to kill nil boundary node")
 	}
-	r.Kill(r.BoundaryNode, peer.NewPeerStore(0, 0))
+	r.Kill(r.BoundaryNode, peer.NewMemoryPeerStore(0, 0))
 
 	// The resulting boundary neighbor should now be one from the static
 	// table, with high proximity.
@@ -0,0 +1,227 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"dht/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Keyed by infohash. Values are the encoded contacts, see
+	// encodeContacts.
+	peersBucket = []byte("peers")
+	// Keyed by infohash. Values are 2-byte ports.
+	downloadsBucket = []byte("downloads")
+)
+
+// BoltPeerStore is a MemoryPeerStore persisted in a bbolt database file, so
+// that a restarted node can answer get_peers queries straight away. Reads are
+// served from memory. Changes are written to the file every flush period,
+// and on Close.
+type BoltPeerStore struct {
+	*MemoryPeerStore
+	db *bolt.DB
+	// Infohashes whose contacts changed since the last flush, and whether
+	// the local downloads changed. Protected by MemoryPeerStore.mu.
+	dirty      map[util.InfoHash]bool
+	localDirty bool
+	stop       chan bool
+	done       chan bool
+}
+
+// OpenBoltPeerStore opens or creates the peer database at path, and loads it
+// in memory. The limits are those of NewMemoryPeerStore. If flushPeriod is
+// positive, changes are written to the file periodically. Otherwise they are
+// only written by Flush and Close.
+func OpenBoltPeerStore(path string, maxInfoHashes, maxInfoHashPeers int, flushPeriod time.Duration) (*BoltPeerStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltPeerStore{
+		MemoryPeerStore: NewMemoryPeerStore(maxInfoHashes, maxInfoHashPeers),
+		db:              db,
+		dirty:           make(map[util.InfoHash]bool),
+		stop:            make(chan bool),
+		done:            make(chan bool),
+	}
+	s.changed = func(ih util.InfoHash) { s.dirty[ih] = true }
+	s.localChanged = func() { s.localDirty = true }
+	// Infohashes evicted while loading, if the limits were lowered, are
+	// marked dirty and deleted from the file on the next flush.
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.flushLoop(flushPeriod)
+	return s, nil
+}
+
+func (s *BoltPeerStore) load() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		peers, err := tx.CreateBucketIfNotExists(peersBucket)
+		if err != nil {
+			return err
+		}
+		downloads, err := tx.CreateBucketIfNotExists(downloadsBucket)
+		if err != nil {
+			return err
+		}
+		err = peers.ForEach(func(k, v []byte) error {
+			c := newInfoHashContacts()
+			if err := decodeContacts(c, v); err != nil {
+				return fmt.Errorf("peer: bad contacts for infohash %x: %v", k, err)
+			}
+			s.InfoHashPeers.Add(string(k), c)
+			s.bytes += c.memory()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return downloads.ForEach(func(k, v []byte) error {
+			if len(v) != 2 {
+				return fmt.Errorf("peer: bad port for infohash %x", k)
+			}
+			s.LocalActiveDownloads[util.InfoHash(k)] = int(binary.BigEndian.Uint16(v))
+			return nil
+		})
+	})
+}
+
+func (s *BoltPeerStore) flushLoop(period time.Duration) {
+	defer close(s.done)
+	if period <= 0 {
+		<-s.stop
+		return
+	}
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the pending changes to the file.
+func (s *BoltPeerStore) Flush() error {
+	s.mu.Lock()
+	contacts := make(map[util.InfoHash][]byte, len(s.dirty))
+	for ih := range s.dirty {
+		// Not using get, so that flushing doesn't expire contacts.
+		contacts[ih] = nil
+		if v, ok := s.InfoHashPeers.Get(string(ih)); ok {
+			if c, ok := v.(*infoHashContacts); ok {
+				contacts[ih] = encodeContacts(c)
+			}
+		}
+	}
+	var downloads map[util.InfoHash]int
+	if s.localDirty {
+		downloads = make(map[util.InfoHash]int, len(s.LocalActiveDownloads))
+		for ih, port := range s.LocalActiveDownloads {
+			downloads[ih] = port
+		}
+	}
+	s.dirty = make(map[util.InfoHash]bool)
+	s.localDirty = false
+	s.mu.Unlock()
+
+	if len(contacts) == 0 && downloads == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		peers := tx.Bucket(peersBucket)
+		for ih, v := range contacts {
+			var err error
+			if v == nil {
+				err = peers.Delete([]byte(ih))
+			} else {
+				err = peers.Put([]byte(ih), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if downloads == nil {
+			return nil
+		}
+		if err := tx.DeleteBucket(downloadsBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(downloadsBucket)
+		if err != nil {
+			return err
+		}
+		for ih, port := range downloads {
+			v := make([]byte, 2)
+			binary.BigEndian.PutUint16(v, uint16(port))
+			if err := b.Put([]byte(ih), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close flushes the pending changes and closes the file.
+func (s *BoltPeerStore) Close() error {
+	close(s.stop)
+	<-s.done
+	err := s.Flush()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encodeContacts encodes the contacts of an infohash as a sequence of: one
+// byte with the contact length, the contact, the announce time in Unix
+// nanoseconds as 8 bytes, and one byte that is 1 if the contact is alive.
+// It returns nil if there are no contacts.
+func encodeContacts(c *infoHashContacts) []byte {
+	var b []byte
+	for _, set := range []*peerContactsSet{c.v4, c.v6} {
+		for contact, alive := range set.set {
+			b = append(b, byte(len(contact)))
+			b = append(b, contact...)
+			b = binary.BigEndian.AppendUint64(b, uint64(set.announced[contact].UnixNano()))
+			if alive {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		}
+	}
+	return b
+}
+
+func decodeContacts(c *infoHashContacts, b []byte) error {
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n+8+1 {
+			return fmt.Errorf("truncated contact")
+		}
+		contact := string(b[1 : 1+n])
+		announced := time.Unix(0, int64(binary.BigEndian.Uint64(b[1+n:])))
+		alive := b[1+n+8] == 1
+		b = b[1+n+8+1:]
+		set := c.family(contact)
+		if set == nil {
+			return fmt.Errorf("contact of invalid length %d", n)
+		}
+		set.putAt(contact, announced)
+		if !alive {
+			set.kill(contact)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dht/util"
+)
+
+func TestBoltPeerStore(t *testing.T) {
+	ih, err := util.DecodeInfoHash("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	if err != nil {
+		t.Fatalf("DecodeInfoHash: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "peers.db")
+	s, err := OpenBoltPeerStore(path, 10, 10, 0)
+	if err != nil {
+		t.Fatalf("OpenBoltPeerStore: %v", err)
+	}
+	v4 := util.DottedPortToBinary("1.2.3.4:6881")
+	v6 := util.DottedPortToBinary("[2001:db8::1]:6881")
+	old := util.DottedPortToBinary("1.2.3.5:6881")
+	s.AddContact(ih, v4)
+	s.AddContact(ih, v6)
+	s.AddContact(ih, old)
+	s.get(ih).v4.announced[old] = time.Now().Add(-time.Hour)
+	s.AddLocalDownload(ih, 6881)
+	usage := s.MemoryUsage()
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s, err = OpenBoltPeerStore(path, 10, 10, 0)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer s.Close()
+	if got := s.MemoryUsage(); got != usage {
+		t.Fatalf("MemoryUsage after reopening = %d, wanted %d", got, usage)
+	}
+	if got := s.Count(ih); got != 3 {
+		t.Fatalf("Count after reopening = %d, wanted 3", got)
+	}
+	if got := s.HasLocalDownload(ih); got != 6881 {
+		t.Fatalf("HasLocalDownload after reopening = %d, wanted 6881", got)
+	}
+	if got := s.PeerContacts6(ih); len(got) != 1 || got[0] != v6 {
+		t.Fatalf("PeerContacts6 after reopening = %q, wanted the IPv6 contact", got)
+	}
+	// Announce times are kept.
+	s.SetPeerTTL(30 * time.Minute)
+	if got := s.PeerContacts(ih); len(got) != 1 || got[0] != v4 {
+		t.Fatalf("PeerContacts after reopening = %q, wanted only the fresh IPv4 contact", got)
+	}
+}
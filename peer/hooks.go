@@ -0,0 +1,29 @@
+package peer
+
+import "dht/util"
+
+// Reasons for a peer contact being dropped, as reported in PeerEvent.Reason.
+const (
+	// Dropped to make room for another contact of the same infohash.
+	ReasonFull = "full"
+	// The whole infohash was evicted from the store.
+	ReasonEvicted = "infohash evicted"
+	// The peer didn't announce within the peer TTL, see PeerStore.SetPeerTTL.
+	ReasonExpired = "expired"
+)
+
+// PeerEvent describes a change of a peer contact in the store.
+type PeerEvent struct {
+	InfoHash util.InfoHash
+	// Contact is the peer address in binary format.
+	Contact string
+	// Reason is empty for additions.
+	Reason string
+}
+
+// Hooks receives peer store events. Methods are called synchronously, from
+// the goroutine that changed the store.
+type Hooks interface {
+	PeerStored(e PeerEvent)
+	PeerDropped(e PeerEvent)
+}
@@ -3,6 +3,9 @@ package peer
 import (
 	"container/ring"
 	"dht/util"
+	"expvar"
+	"sync"
+	"time"
 
 	"github.com/golang/groupcache/lru"
 )
@@ -10,10 +13,16 @@ import (
 // For the inner map, the key address in binary form. value=ignored.
 type peerContactsSet struct {
 	set map[string]bool
+	// Time of the last announce of each contact.
+	announced map[string]time.Time
 	// Needed to ensure different peers are returned each time.
 	ring *ring.Ring
 }
 
+func newPeerContactsSet() *peerContactsSet {
+	return &peerContactsSet{set: make(map[string]bool), announced: make(map[string]time.Time)}
+}
+
 // next returns up to 8 peer contacts, if available. Further calls will return a
 // different set of contacts, if possible.
 func (p *peerContactsSet) next() []string {
@@ -23,27 +32,16 @@ func (p *peerContactsSet) next() []string {
 	}
 	x := make([]string, 0, count)
 	xx := make(map[string]bool) //maps are easier to dedupe
-	for range p.set {
-		nid := p.ring.Move(1).Value.(string)
-		if _, ok := xx[nid]; p.set[nid] && !ok {
+	// Alive contacts first.
+	for i := 0; i < len(p.set) && len(xx) < count; i++ {
+		p.ring = p.ring.Next()
+		if nid := p.ring.Value.(string); p.set[nid] {
 			xx[nid] = true
 		}
-		if len(xx) >= count {
-			break
-		}
 	}
-
-	if len(xx) < count {
-		for range p.set {
-			nid := p.ring.Move(1).Value.(string)
-			if _, ok := xx[nid]; ok {
-				continue
-			}
-			xx[nid] = true
-			if len(xx) >= count {
-				break
-			}
-		}
+	for i := 0; i < len(p.set) && len(xx) < count; i++ {
+		p.ring = p.ring.Next()
+		xx[p.ring.Value.(string)] = true
 	}
 	for id := range xx {
 		x = append(x, id)
@@ -51,17 +49,26 @@ func (p *peerContactsSet) next() []string {
 	return x
 }
 
-// put adds a peerContact to an infohash contacts set. peerContact must be a binary encoded contact
-// address where the first four bytes form the IP and the last byte is the port. IPv6 addresses are
-// not currently supported. peerContact with less than 6 bytes will not be stored.
+// put adds a peerContact to an infohash contacts set, or refreshes its announce time.
+// peerContact must be a binary encoded contact address, where the first 4 bytes (IPv4)
+// or 16 bytes (IPv6) form the IP and the last two bytes are the port. peerContact with
+// less than 6 bytes will not be stored. Returns true if the contact was added or
+// revived.
 func (p *peerContactsSet) put(peerContact string) bool {
+	return p.putAt(peerContact, time.Now())
+}
+
+// putAt is like put, with the given announce time.
+func (p *peerContactsSet) putAt(peerContact string, announced time.Time) bool {
 	if len(peerContact) < 6 {
 		return false
 	}
-	if ok := p.set[peerContact]; ok {
-		return false
-	}
+	alive, ok := p.set[peerContact]
 	p.set[peerContact] = true
+	p.announced[peerContact] = announced
+	if ok {
+		return !alive
+	}
 	r := &ring.Ring{Value: peerContact}
 	if p.ring == nil {
 		p.ring = r
@@ -71,38 +78,66 @@ func (p *peerContactsSet) put(peerContact string) bool {
 	return true
 }
 
+// unlinkNext removes the contact after p.ring and returns it.
+func (p *peerContactsSet) unlinkNext() string {
+	var dn string
+	if len(p.set) == 1 {
+		dn = p.ring.Value.(string)
+		p.ring = nil
+	} else {
+		dn = p.ring.Unlink(1).Value.(string)
+	}
+	delete(p.set, dn)
+	delete(p.announced, dn)
+	return dn
+}
+
 // drop cycles throught the peerContactSet and deletes the contact if it finds it
 // if the argument is empty, it first tries to drop a dead peer
 func (p *peerContactsSet) drop(peerContact string) string {
+	if len(p.set) == 0 {
+		return ""
+	}
 	if peerContact == "" {
 		if c := p.dropDead(); c != "" {
 			return c
-		} else {
-			return p.drop(p.ring.Next().Value.(string))
 		}
+		return p.unlinkNext()
 	}
-	for i := 0; i < p.ring.Len()+1; i++ {
-		if p.ring.Move(1).Value.(string) == peerContact {
-			dn := p.ring.Unlink(1).Value.(string)
-			delete(p.set, dn)
-			return dn
-		}
+	if _, ok := p.set[peerContact]; !ok {
+		return ""
 	}
-	return ""
+	for p.ring.Next().Value.(string) != peerContact {
+		p.ring = p.ring.Next()
+	}
+	return p.unlinkNext()
 }
 
 // dropDead drops the first dead contact, returns the id if a contact was dropped
 func (p *peerContactsSet) dropDead() string {
-	for i := 0; i < p.ring.Len()+1; i++ {
-		if !p.set[p.ring.Move(1).Value.(string)] {
-			dn := p.ring.Unlink(1).Value.(string)
-			delete(p.set, dn)
-			return dn
+	for i := 0; i < len(p.set); i++ {
+		if !p.set[p.ring.Next().Value.(string)] {
+			return p.unlinkNext()
 		}
+		p.ring = p.ring.Next()
 	}
 	return ""
 }
 
+// expire drops the contacts that didn't announce during the last ttl, and
+// returns them.
+func (p *peerContactsSet) expire(ttl time.Duration) (expired []string) {
+	for c, t := range p.announced {
+		if time.Since(t) > ttl {
+			expired = append(expired, c)
+		}
+	}
+	for _, c := range expired {
+		p.drop(c)
+	}
+	return expired
+}
+
 func (p *peerContactsSet) kill(peerContact string) {
 	if ok := p.set[peerContact]; ok {
 		p.set[peerContact] = false
@@ -124,107 +159,347 @@ func (p *peerContactsSet) Alive() int {
 	return ret
 }
 
-func NewPeerStore(maxInfoHashes, maxInfoHashPeers int) *PeerStore {
-	return &PeerStore{
+// NewMemoryPeerStore creates a PeerStore that keeps the contacts of up to
+// maxInfoHashes infohashes in memory, evicting the least recently used ones.
+func NewMemoryPeerStore(maxInfoHashes, maxInfoHashPeers int) *MemoryPeerStore {
+	h := &MemoryPeerStore{
 		InfoHashPeers:        lru.New(maxInfoHashes),
 		LocalActiveDownloads: make(map[util.InfoHash]int),
 		MaxInfoHashes:        maxInfoHashes,
 		MaxInfoHashPeers:     maxInfoHashPeers,
 	}
+	h.InfoHashPeers.OnEvicted = h.evicted
+	return h
 }
 
-type PeerStore struct {
+// MemoryPeerStore is an in-memory PeerStore. It is safe for concurrent use.
+type MemoryPeerStore struct {
+	mu sync.Mutex
 	// cache of peers for infohashes. Each key is an infohash and the
-	// values are peerContactsSet.
+	// values are infoHashContacts. Accessing it directly is not safe for
+	// concurrent use with the methods, which should be used instead.
 	InfoHashPeers *lru.Cache
-	// infoHashes for which we are peers.
+	// infoHashes for which we are peers. Like InfoHashPeers, it should only
+	// be accessed through the methods.
 	LocalActiveDownloads map[util.InfoHash]int // value is port number
 	MaxInfoHashes        int
 	MaxInfoHashPeers     int
+	// PeerTTL is how long contacts are kept after their last announce. Zero
+	// means they are kept until pushed out by newer ones.
+	PeerTTL time.Duration
+	// Hooks, if set, is notified of peer contacts stored and dropped. Hooks
+	// are called with the store locked, so they must not call back into it.
+	Hooks Hooks
+	// MemoryLimit, if positive, is the memory in bytes the contacts may
+	// use. Beyond it, the least recently used infohashes are evicted.
+	MemoryLimit int64
+	// Estimated memory used by the contacts, see memory.
+	bytes int64
+
+	// Called with the store locked when the contacts of an infohash, or the
+	// local downloads, change. Used by BoltPeerStore.
+	changed      func(ih util.InfoHash)
+	localChanged func()
+}
+
+// SetPeerTTL implements PeerStore.
+func (h *MemoryPeerStore) SetPeerTTL(ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.PeerTTL = ttl
+}
+
+// SetMemoryLimit implements PeerStore.
+func (h *MemoryPeerStore) SetMemoryLimit(bytes int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.MemoryLimit = bytes
+	h.enforceMemoryLimit()
+}
+
+// MemoryUsage implements PeerStore.
+func (h *MemoryPeerStore) MemoryUsage() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.bytes
+}
+
+// enforceMemoryLimit evicts the least recently used infohashes until the
+// contacts fit in MemoryLimit. The most recently used one is always kept.
+func (h *MemoryPeerStore) enforceMemoryLimit() {
+	for h.MemoryLimit > 0 && h.bytes > h.MemoryLimit && h.InfoHashPeers.Len() > 1 {
+		totalMemoryEvictions.Add(1)
+		h.InfoHashPeers.RemoveOldest()
+	}
+}
+
+// SetHooks implements PeerStore.
+func (h *MemoryPeerStore) SetHooks(hooks Hooks) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Hooks = hooks
+}
+
+func (h *MemoryPeerStore) changedInfoHash(ih util.InfoHash) {
+	if h.changed != nil {
+		h.changed(ih)
+	}
+}
+
+func (h *MemoryPeerStore) changedLocalDownloads() {
+	if h.localChanged != nil {
+		h.localChanged()
+	}
+}
+
+// infoHashContacts holds the peer contacts of an infohash, with separate sets
+// for each address family.
+type infoHashContacts struct {
+	v4, v6 *peerContactsSet
+}
+
+func newInfoHashContacts() *infoHashContacts {
+	return &infoHashContacts{v4: newPeerContactsSet(), v6: newPeerContactsSet()}
+}
+
+// Rough estimates of the memory used by the store, on 64-bit platforms.
+const (
+	// An infohash without contacts, with its LRU entry.
+	infoHashBytes = 400
+	// The entries of a contact in the set and announced maps, and its ring
+	// element, without the contact itself.
+	contactBytes = 160
+)
+
+// memory estimates the memory used by the contacts of an infohash.
+func (c *infoHashContacts) memory() int64 {
+	return infoHashBytes + int64(c.v4.Size()*(contactBytes+6)+c.v6.Size()*(contactBytes+18))
 }
 
-func (h *PeerStore) Get(ih util.InfoHash) *peerContactsSet {
+// family returns the set for peerContact, based on its length: 6 bytes for
+// IPv4 contacts and 18 bytes for IPv6 ones. It returns nil for other lengths.
+func (c *infoHashContacts) family(peerContact string) *peerContactsSet {
+	switch len(peerContact) {
+	case 6:
+		return c.v4
+	case 18:
+		return c.v6
+	}
+	return nil
+}
+
+// evicted is called by the LRU when an infohash is pushed out.
+func (h *MemoryPeerStore) evicted(key lru.Key, value interface{}) {
+	peers, ok := value.(*infoHashContacts)
+	ih := util.InfoHash(key.(string))
+	h.changedInfoHash(ih)
+	if !ok {
+		return
+	}
+	h.bytes -= peers.memory()
+	if h.Hooks == nil {
+		return
+	}
+	for _, set := range []*peerContactsSet{peers.v4, peers.v6} {
+		for c := range set.set {
+			h.Hooks.PeerDropped(PeerEvent{InfoHash: ih, Contact: c, Reason: ReasonEvicted})
+		}
+	}
+}
+
+func (h *MemoryPeerStore) stored(ih util.InfoHash, peerContact string, ok bool) bool {
+	if ok && h.Hooks != nil {
+		h.Hooks.PeerStored(PeerEvent{InfoHash: ih, Contact: peerContact})
+	}
+	return ok
+}
+
+func (h *MemoryPeerStore) get(ih util.InfoHash) *infoHashContacts {
 	c, ok := h.InfoHashPeers.Get(string(ih))
 	if !ok {
 		return nil
 	}
-	contacts := c.(*peerContactsSet)
+	contacts, ok := c.(*infoHashContacts)
+	if !ok {
+		return nil
+	}
+	before := contacts.memory()
+	h.expire(ih, contacts.v4)
+	h.expire(ih, contacts.v6)
+	h.bytes += contacts.memory() - before
 	return contacts
 }
 
-// count shows the number of known peers for the given infohash.
-func (h *PeerStore) Count(ih util.InfoHash) int {
-	peers := h.Get(ih)
+// expire drops the contacts of ih that are older than PeerTTL.
+func (h *MemoryPeerStore) expire(ih util.InfoHash, peers *peerContactsSet) {
+	if h.PeerTTL <= 0 {
+		return
+	}
+	expired := peers.expire(h.PeerTTL)
+	if len(expired) > 0 {
+		h.changedInfoHash(ih)
+	}
+	for _, c := range expired {
+		totalExpiredPeers.Add(1)
+		if h.Hooks != nil {
+			h.Hooks.PeerDropped(PeerEvent{InfoHash: ih, Contact: c, Reason: ReasonExpired})
+		}
+	}
+}
+
+// count shows the number of known peers for the given infohash, of both
+// address families.
+func (h *MemoryPeerStore) Count(ih util.InfoHash) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
 	if peers == nil {
 		return 0
 	}
-	return peers.Size()
+	return peers.v4.Size() + peers.v6.Size()
+}
+
+// Alive returns the number of peers for ih that are not known to be dead, of
+// both address families.
+func (h *MemoryPeerStore) Alive(ih util.InfoHash) int {
+	return h.Alive4(ih) + h.Alive6(ih)
 }
 
-func (h *PeerStore) Alive(ih util.InfoHash) int {
-	peers := h.Get(ih)
+// Alive4 is like Alive, but only counts IPv4 peers.
+func (h *MemoryPeerStore) Alive4(ih util.InfoHash) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
 	if peers == nil {
 		return 0
 	}
-	return peers.Alive()
+	return peers.v4.Alive()
 }
 
-// peerContacts returns a random set of 8 peers for the ih InfoHash.
-func (h *PeerStore) PeerContacts(ih util.InfoHash) []string {
-	peers := h.Get(ih)
+// Alive6 is like Alive, but only counts IPv6 peers.
+func (h *MemoryPeerStore) Alive6(ih util.InfoHash) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
+	if peers == nil {
+		return 0
+	}
+	return peers.v6.Alive()
+}
+
+// peerContacts returns a random set of 8 IPv4 peers for the ih InfoHash.
+func (h *MemoryPeerStore) PeerContacts(ih util.InfoHash) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
 	if peers == nil {
 		return nil
 	}
-	return peers.next()
+	return peers.v4.next()
+}
+
+// PeerContacts6 is like PeerContacts, but returns IPv6 peers.
+func (h *MemoryPeerStore) PeerContacts6(ih util.InfoHash) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
+	if peers == nil {
+		return nil
+	}
+	return peers.v6.next()
 }
 
 // addContact as a peer for the provided ih. Returns true if the contact was
-// added, false otherwise (e.g: already present, or invalid).
-func (h *PeerStore) AddContact(ih util.InfoHash, peerContact string) bool {
-	var peers *peerContactsSet
-	p, ok := h.InfoHashPeers.Get(string(ih))
-	if ok {
-		var okType bool
-		peers, okType = p.(*peerContactsSet)
-		if okType && peers != nil {
-			if peers.Size() >= h.MaxInfoHashPeers {
-				if _, ok := peers.set[peerContact]; ok {
-					return false
-				}
-				if peers.drop("") == "" {
-					return false
-				}
-			}
-			h.InfoHashPeers.Add(string(ih), peers)
-			return peers.put(peerContact)
+// added, false otherwise (e.g: already present, or invalid). MaxInfoHashPeers
+// applies to each address family separately.
+func (h *MemoryPeerStore) AddContact(ih util.InfoHash, peerContact string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := h.get(ih)
+	var before int64
+	if peers == nil {
+		peers = newInfoHashContacts()
+	} else {
+		before = peers.memory()
+	}
+	set := peers.family(peerContact)
+	if set == nil {
+		return false
+	}
+	h.changedInfoHash(ih)
+	if set.Size() >= h.MaxInfoHashPeers {
+		if _, ok := set.set[peerContact]; ok {
+			return h.stored(ih, peerContact, set.put(peerContact))
+		}
+		dropped := set.drop("")
+		if dropped == "" {
+			return false
+		}
+		if h.Hooks != nil {
+			h.Hooks.PeerDropped(PeerEvent{InfoHash: ih, Contact: dropped, Reason: ReasonFull})
 		}
-		// Bogus peer contacts, reset them.
 	}
-	peers = &peerContactsSet{set: make(map[string]bool)}
 	h.InfoHashPeers.Add(string(ih), peers)
-	return peers.put(peerContact)
+	ok := set.put(peerContact)
+	h.bytes += peers.memory() - before
+	h.enforceMemoryLimit()
+	return h.stored(ih, peerContact, ok)
 }
 
-func (h *PeerStore) KillContact(peerContact string) {
+func (h *MemoryPeerStore) KillContact(peerContact string) {
 	if h == nil {
 		return
 	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	for ih := range h.LocalActiveDownloads {
-		if p := h.Get(ih); p != nil {
-			p.kill(peerContact)
+		if p := h.get(ih); p != nil {
+			if set := p.family(peerContact); set != nil && set.set[peerContact] {
+				set.kill(peerContact)
+				h.changedInfoHash(ih)
+			}
 		}
 	}
 }
 
-func (h *PeerStore) AddLocalDownload(ih util.InfoHash, port int) {
+func (h *MemoryPeerStore) AddLocalDownload(ih util.InfoHash, port int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.LocalActiveDownloads[ih] = port
+	h.changedLocalDownloads()
 }
 
-func (h *PeerStore) HasLocalDownload(ih util.InfoHash) (port int) {
+func (h *MemoryPeerStore) HasLocalDownload(ih util.InfoHash) (port int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	port = h.LocalActiveDownloads[ih]
 	return
 }
 
-func (h *PeerStore) RemoveLocalDownload(ih util.InfoHash) {
+func (h *MemoryPeerStore) RemoveLocalDownload(ih util.InfoHash) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	delete(h.LocalActiveDownloads, ih)
+	h.changedLocalDownloads()
 }
+
+// LocalDownloads returns a copy of the infohashes for which we are peers,
+// with the port announced for each.
+func (h *MemoryPeerStore) LocalDownloads() map[util.InfoHash]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make(map[util.InfoHash]int, len(h.LocalActiveDownloads))
+	for ih, port := range h.LocalActiveDownloads {
+		ret[ih] = port
+	}
+	return ret
+}
+
+var (
+	// totalExpiredPeers counts the peer contacts dropped because they
+	// stopped announcing.
+	totalExpiredPeers = expvar.NewInt("totalExpiredPeers")
+	// totalMemoryEvictions counts the infohashes evicted because of
+	// MemoryLimit.
+	totalMemoryEvictions = expvar.NewInt("totalMemoryEvictions")
+)
@@ -2,7 +2,10 @@ package peer
 
 import (
 	"dht/util"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPeerStorage(t *testing.T) {
@@ -11,7 +14,7 @@ func TestPeerStorage(t *testing.T) {
 		t.Fatalf("DecodeInfoHash: %v", err)
 	}
 	// Allow 1 IH and 2 peers.
-	p := NewPeerStore(1, 2)
+	p := NewMemoryPeerStore(1, 2)
 
 	if ok := p.AddContact(ih, "abcedf"); !ok {
 		t.Fatalf("AddContact(1/2) expected true, got false")
@@ -47,3 +50,162 @@ func TestPeerStorage(t *testing.T) {
 		t.Fatalf("ih2 got Count %d, wanted 1", p.Count(ih))
 	}
 }
+
+func TestPeerStoreConcurrent(t *testing.T) {
+	ih, err := util.DecodeInfoHash("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	if err != nil {
+		t.Fatalf("DecodeInfoHash: %v", err)
+	}
+	p := NewMemoryPeerStore(10, 100)
+	p.AddLocalDownload(ih, 6881)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p.AddContact(ih, fmt.Sprintf("%03d%03d", i, j))
+				p.Count(ih)
+				p.PeerContacts(ih)
+				p.LocalDownloads()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := p.Count(ih); got != 100 {
+		t.Fatalf("Count = %d, wanted 100", got)
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	ih, err := util.DecodeInfoHash("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	if err != nil {
+		t.Fatalf("DecodeInfoHash: %v", err)
+	}
+	p := NewMemoryPeerStore(1, 10)
+	p.PeerTTL = 30 * time.Minute
+	p.AddContact(ih, "abcdef")
+	p.AddContact(ih, "ABCDEF")
+	p.AddContact(ih, "XXXXXX")
+	peers := p.get(ih).v4
+	peers.announced["ABCDEF"] = time.Now().Add(-20 * time.Minute)
+	// Announcing again refreshes the contact.
+	p.AddContact(ih, "ABCDEF")
+	if time.Since(peers.announced["ABCDEF"]) > time.Minute {
+		t.Fatalf("announce time not refreshed")
+	}
+	peers.announced["ABCDEF"] = time.Now().Add(-20 * time.Minute)
+	peers.announced["abcdef"] = time.Now().Add(-time.Hour)
+
+	expired := totalExpiredPeers.Value()
+	contacts := p.PeerContacts(ih)
+	if len(contacts) != 2 {
+		t.Fatalf("PeerContacts returned %q, wanted 2 contacts", contacts)
+	}
+	for _, c := range contacts {
+		if c == "abcdef" {
+			t.Fatalf("PeerContacts returned an expired contact")
+		}
+	}
+	if got := totalExpiredPeers.Value() - expired; got != 1 {
+		t.Fatalf("%d contacts counted as expired, wanted 1", got)
+	}
+	if p.Count(ih) != 2 {
+		t.Fatalf("Count = %d after expiry, wanted 2", p.Count(ih))
+	}
+}
+
+func TestPeerContactsRotate(t *testing.T) {
+	ih, err := util.DecodeInfoHash("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	if err != nil {
+		t.Fatalf("DecodeInfoHash: %v", err)
+	}
+	p := NewMemoryPeerStore(1, 100)
+	for i := 0; i < 2*util.KNodes; i++ {
+		p.AddContact(ih, fmt.Sprintf("%06d", i))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		contacts := p.PeerContacts(ih)
+		if len(contacts) != util.KNodes {
+			t.Fatalf("PeerContacts returned %d contacts, wanted %d", len(contacts), util.KNodes)
+		}
+		for _, c := range contacts {
+			seen[c] = true
+		}
+	}
+	if len(seen) != 2*util.KNodes {
+		t.Fatalf("two PeerContacts calls returned %d different contacts, wanted %d", len(seen), 2*util.KNodes)
+	}
+}
+
+func TestPeerStoreFamilies(t *testing.T) {
+	ih, err := util.DecodeInfoHash("d1c5676ae7ac98e8b19f63565905105e3c4c37a2")
+	if err != nil {
+		t.Fatalf("DecodeInfoHash: %v", err)
+	}
+	p := NewMemoryPeerStore(1, 2)
+	v4 := util.DottedPortToBinary("1.2.3.4:6881")
+	v6 := util.DottedPortToBinary("[2001:db8::1]:6881")
+	if !p.AddContact(ih, v4) || !p.AddContact(ih, v6) {
+		t.Fatalf("AddContact failed")
+	}
+	if p.AddContact(ih, "1234567") {
+		t.Fatalf("AddContact accepted a contact of invalid length")
+	}
+	// The limit applies to each family.
+	p.AddContact(ih, util.DottedPortToBinary("[2001:db8::2]:6881"))
+	p.AddContact(ih, util.DottedPortToBinary("[2001:db8::3]:6881"))
+	if got := p.Count(ih); got != 3 {
+		t.Fatalf("Count = %d, wanted 3", got)
+	}
+	if got := p.PeerContacts(ih); len(got) != 1 || got[0] != v4 {
+		t.Fatalf("PeerContacts = %q, wanted only the IPv4 contact", got)
+	}
+	if got := p.PeerContacts6(ih); len(got) != 2 {
+		t.Fatalf("PeerContacts6 returned %d contacts, wanted 2", len(got))
+	}
+	p.AddLocalDownload(ih, 6881)
+	p.KillContact(v4)
+	if p.Alive4(ih) != 0 || p.Alive6(ih) != 2 || p.Alive(ih) != 2 {
+		t.Fatalf("Alive4, Alive6, Alive = %d, %d, %d, wanted 0, 2, 2", p.Alive4(ih), p.Alive6(ih), p.Alive(ih))
+	}
+}
+
+func TestPeerStoreMemoryLimit(t *testing.T) {
+	p := NewMemoryPeerStore(100, 100)
+	if p.MemoryUsage() != 0 {
+		t.Fatalf("empty store uses %d bytes", p.MemoryUsage())
+	}
+	ih := util.InfoHash("aaaaaaaaaaaaaaaaaaaa")
+	p.AddContact(ih, "abcdef")
+	one := p.MemoryUsage()
+	p.AddContact(ih, "abcdeg")
+	if p.MemoryUsage() <= one {
+		t.Fatalf("MemoryUsage didn't grow with a contact")
+	}
+	p.AddContact(ih, "abcdeg")
+	two := p.MemoryUsage()
+
+	// Room for about three infohashes with two contacts.
+	p.SetMemoryLimit(3*two + two/2)
+	for i := 0; i < 10; i++ {
+		x := util.InfoHash(fmt.Sprintf("%020d", i))
+		p.AddContact(x, "abcdef")
+		p.AddContact(x, "abcdeg")
+		if p.MemoryUsage() > 3*two+two/2 {
+			t.Fatalf("MemoryUsage %d exceeds the limit after %d infohashes", p.MemoryUsage(), i+1)
+		}
+	}
+	if p.Count(util.InfoHash(fmt.Sprintf("%020d", 9))) != 2 {
+		t.Errorf("the most recent infohash was evicted")
+	}
+	if p.Count(ih) != 0 {
+		t.Errorf("the least recent infohash was not evicted")
+	}
+
+	p.SetMemoryLimit(1)
+	if p.MemoryUsage() != two {
+		t.Errorf("MemoryUsage is %d with one infohash left, wanted %d", p.MemoryUsage(), two)
+	}
+}
@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"time"
+
+	"dht/util"
+)
+
+// PeerStore keeps the peer contacts announced for infohashes, and the
+// infohashes we are downloading ourselves. Contacts are binary encoded
+// addresses: 6 bytes for IPv4 and 18 bytes for IPv6. Implementations must be
+// safe for concurrent use.
+//
+// MemoryPeerStore keeps everything in memory, and BoltPeerStore persists it
+// in a file.
+type PeerStore interface {
+	// AddContact adds peerContact as a peer for ih, or refreshes its
+	// announce time. Returns true if the contact was added.
+	AddContact(ih util.InfoHash, peerContact string) bool
+	// KillContact marks peerContact as dead for our local downloads.
+	KillContact(peerContact string)
+	// PeerContacts returns up to util.KNodes IPv4 peers for ih, trying to
+	// return different ones at each call.
+	PeerContacts(ih util.InfoHash) []string
+	// PeerContacts6 is like PeerContacts, for IPv6 peers.
+	PeerContacts6(ih util.InfoHash) []string
+	// Count returns the number of peers known for ih.
+	Count(ih util.InfoHash) int
+	// Alive returns the number of peers for ih that are not known to be
+	// dead, and Alive4 and Alive6 the same by address family.
+	Alive(ih util.InfoHash) int
+	Alive4(ih util.InfoHash) int
+	Alive6(ih util.InfoHash) int
+
+	// AddLocalDownload records that we are a peer for ih, on port.
+	AddLocalDownload(ih util.InfoHash, port int)
+	// HasLocalDownload returns the port for ih, or 0 if we are not a peer.
+	HasLocalDownload(ih util.InfoHash) (port int)
+	RemoveLocalDownload(ih util.InfoHash)
+	// LocalDownloads returns a copy of the local downloads and their ports.
+	LocalDownloads() map[util.InfoHash]int
+
+	// SetPeerTTL sets how long contacts are kept after their last
+	// announce. Zero disables expiry.
+	SetPeerTTL(ttl time.Duration)
+	// SetHooks sets the receiver of peer events.
+	SetHooks(h Hooks)
+	// SetMemoryLimit sets the memory in bytes the contacts may use. Beyond
+	// it, the least recently used infohashes are evicted. Zero disables
+	// the limit.
+	SetMemoryLimit(bytes int64)
+	// MemoryUsage estimates the memory used by the contacts, in bytes.
+	MemoryUsage() int64
+}
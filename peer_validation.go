@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"expvar"
+	"net"
+	"time"
+
+	"dht/util"
+)
+
+// PeerVerifier checks the peers returned by get_peers replies before they
+// are stored and reported, see Config.PeerVerifier.
+type PeerVerifier interface {
+	// VerifyPeer returns true if peerContact, a binary encoded address, is
+	// a genuine peer for ih, for example after connecting to it. It's
+	// called in its own goroutine, and may block.
+	VerifyPeer(ih util.InfoHash, peerContact string) bool
+}
+
+const (
+	// Maximum number of PeerVerifier calls running at once.
+	maxPeerVerifications = 16
+	// How long a candidate rejected by the PeerVerifier is not checked
+	// again.
+	peerVerifyRetryPeriod = 10 * time.Minute
+)
+
+// peerCandidate is a peer returned by get_peers replies, while it's being
+// validated.
+type peerCandidate struct {
+	// Subnets of the nodes that returned it.
+	subnets map[string]bool
+	// When a node last returned it.
+	seen time.Time
+	// Set while the PeerVerifier checks it.
+	verifying bool
+	// When the PeerVerifier last rejected it, zero if it never did.
+	rejected time.Time
+	// Set once it passed the quorum or the PeerVerifier.
+	valid bool
+}
+
+// validatePeers returns the peers in values, returned by the node at
+// responder for ih, that are valid. If validation is disabled, they all are.
+// The others are kept as candidates, and reported later if they get valid.
+// When there are MaxInfoHashPeers candidates for ih, a new one replaces the
+// least recently seen, see evictCandidate.
+func (d *DHT) validatePeers(ih util.InfoHash, responder net.UDPAddr, values []string) []string {
+	if d.config.PeerQuorum <= 0 && d.config.PeerVerifier == nil {
+		return values
+	}
+	var candidates map[string]*peerCandidate
+	if v, ok := d.peerCandidates.Get(string(ih)); ok {
+		candidates = v.(map[string]*peerCandidate)
+	} else {
+		candidates = make(map[string]*peerCandidate)
+		d.peerCandidates.Add(string(ih), candidates)
+	}
+	subnet := util.Subnet(responder.IP)
+	now := time.Now()
+	var valid []string
+	for _, p := range values {
+		c, ok := candidates[p]
+		if !ok {
+			if len(candidates) >= d.config.MaxInfoHashPeers && !evictCandidate(candidates) {
+				continue
+			}
+			c = &peerCandidate{subnets: make(map[string]bool)}
+			candidates[p] = c
+		}
+		c.seen = now
+		c.subnets[subnet] = true
+		if !c.valid && d.config.PeerQuorum > 0 && len(c.subnets) >= d.config.PeerQuorum {
+			c.valid = true
+			totalQuorumPeers.Add(1)
+		}
+		if c.valid {
+			valid = append(valid, p)
+		} else if d.config.PeerVerifier != nil && !c.verifying && now.Sub(c.rejected) >= peerVerifyRetryPeriod {
+			d.verifyPeer(ih, p, c)
+		}
+	}
+	return valid
+}
+
+// evictCandidate removes the least recently seen of candidates, preferring
+// those that are not valid yet. Those being verified are kept. It returns
+// false if none could be removed.
+func evictCandidate(candidates map[string]*peerCandidate) bool {
+	var victim string
+	var oldest *peerCandidate
+	for p, c := range candidates {
+		if c.verifying {
+			continue
+		}
+		if oldest == nil || oldest.valid && !c.valid ||
+			oldest.valid == c.valid && c.seen.Before(oldest.seen) {
+			victim, oldest = p, c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(candidates, victim)
+	return true
+}
+
+// verifyPeer asks the PeerVerifier about the candidate p in the background,
+// and reports it if approved. If too many checks are running, p is left for
+// the next time it's returned. If rejected, it's checked again when returned
+// after peerVerifyRetryPeriod.
+func (d *DHT) verifyPeer(ih util.InfoHash, p string, c *peerCandidate) {
+	select {
+	case d.peerVerifications <- struct{}{}:
+	default:
+		return
+	}
+	c.verifying = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ok := d.config.PeerVerifier.VerifyPeer(ih, p)
+		<-d.peerVerifications
+		select {
+		case <-d.stop:
+			// The loop may be gone, don't touch the candidate nor
+			// report a peer to a client that's closing down.
+			return
+		default:
+		}
+		if !ok {
+			totalRejectedPeers.Add(1)
+		}
+		d.do(func() {
+			c.verifying = false
+			if !ok {
+				c.rejected = time.Now()
+				return
+			}
+			if c.valid {
+				return
+			}
+			c.valid = true
+			totalVerifiedPeers.Add(1)
+			d.reportPeers(ih, []string{p})
+		})
+	}()
+}
+
+// reportPeers stores the peers for ih and sends them to the client.
+func (d *DHT) reportPeers(ih util.InfoHash, peers []string) {
+	for _, peerContact := range peers {
+		// send peer even if we already have it in store
+		// the underlying client does/should handle dupes
+		d.peerStore.AddContact(ih, peerContact)
+	}
+	if len(peers) > 0 {
+		// Finally, new peers.
+		result := map[util.InfoHash][]string{ih: peers}
+		totalPeers.Add(int64(len(peers)))
+		d.DebugLogger.Debugf("DHT: processGetPeerResults, totalPeers: %v", totalPeers.String())
+		select {
+		case d.PeersRequestResults <- result:
+		case <-d.stop:
+			// if we're closing down and the caller has stopped reading
+			// from PeersRequestResults, drop the result.
+		}
+	}
+}
+
+var (
+	// Peers that got valid by quorum, or approved and rejected by the
+	// PeerVerifier.
+	totalQuorumPeers   = expvar.NewInt("totalQuorumPeers")
+	totalVerifiedPeers = expvar.NewInt("totalVerifiedPeers")
+	totalRejectedPeers = expvar.NewInt("totalRejectedPeers")
+)
@@ -0,0 +1,175 @@
+package dht
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dht/util"
+)
+
+func TestPeerQuorum(t *testing.T) {
+	ih := testInfoHash
+	d := newTestDHT(t, func(c *Config) { c.PeerQuorum = 2 })
+	contact := "\x01\x02\x03\x04\x1a\xe1"
+	for i, test := range []struct {
+		responder net.UDPAddr
+		valid     bool
+	}{
+		{net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, false},
+		// Same /24 subnet, doesn't count.
+		{net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}, false},
+		{net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1}, true},
+		// Once valid, it stays valid.
+		{net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, true},
+	} {
+		valid := d.validatePeers(ih, test.responder, []string{contact})
+		if got := len(valid) == 1; got != test.valid {
+			t.Errorf("reply %d from %v: got valid %v, wanted %v", i, test.responder.IP, got, test.valid)
+		}
+	}
+}
+
+type testVerifier struct {
+	approve map[string]bool
+}
+
+func (v testVerifier) VerifyPeer(ih util.InfoHash, peerContact string) bool {
+	return v.approve[peerContact]
+}
+
+func TestPeerVerifier(t *testing.T) {
+	ih := testInfoHash
+	good := "\x01\x02\x03\x04\x1a\xe1"
+	bad := "\x05\x06\x07\x08\x1a\xe1"
+	d := newTestDHT(t, func(c *Config) {
+		c.PeerVerifier = testVerifier{approve: map[string]bool{good: true}}
+	})
+	responder := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	if valid := d.validatePeers(ih, responder, []string{good, bad}); len(valid) != 0 {
+		t.Errorf("peers %q reported before verification", valid)
+	}
+	select {
+	case r := <-d.PeersRequestResults:
+		if peers := r[ih]; len(peers) != 1 || peers[0] != good {
+			t.Errorf("got peers %q, wanted only the approved one", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the approved peer was not reported")
+	}
+	if n := d.peerStore.Count(ih); n != 1 {
+		t.Errorf("peer store has %d peers, wanted 1", n)
+	}
+}
+
+func TestPeerCandidateEviction(t *testing.T) {
+	ih := testInfoHash
+	d := newTestDHT(t, func(c *Config) {
+		c.PeerQuorum = 2
+		c.MaxInfoHashPeers = 2
+	})
+	first, second, third := "\x01\x02\x03\x04\x1a\xe1", "\x01\x02\x03\x05\x1a\xe1", "\x01\x02\x03\x06\x1a\xe1"
+	a := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b := net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 1}
+	d.validatePeers(ih, a, []string{first, second})
+	v, _ := d.peerCandidates.Get(string(ih))
+	v.(map[string]*peerCandidate)[first].seen = time.Now().Add(-time.Hour)
+
+	// The third candidate replaces the least recently seen one.
+	d.validatePeers(ih, a, []string{third})
+	if valid := d.validatePeers(ih, b, []string{third}); len(valid) != 1 {
+		t.Errorf("new candidate not kept when the candidates are full")
+	}
+	if valid := d.validatePeers(ih, b, []string{first}); len(valid) != 0 {
+		t.Errorf("the evicted candidate kept its quorum")
+	}
+}
+
+func TestPeerVerifierRetry(t *testing.T) {
+	ih := testInfoHash
+	p := "\x01\x02\x03\x04\x1a\xe1"
+	var calls atomic.Int32
+	d := newTestDHT(t, func(c *Config) {
+		// Rejects the first check only.
+		c.PeerVerifier = verifierFunc(func(util.InfoHash, string) bool { return calls.Add(1) > 1 })
+	})
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer d.Stop()
+	responder := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	candidate := func() (rejected time.Time) {
+		d.do(func() {
+			v, _ := d.peerCandidates.Get(string(ih))
+			rejected = v.(map[string]*peerCandidate)[p].rejected
+		})
+		return rejected
+	}
+	d.do(func() { d.validatePeers(ih, responder, []string{p}) })
+	for deadline := time.Now().Add(5 * time.Second); candidate().IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the rejection was not recorded")
+		}
+	}
+
+	// Not checked again until peerVerifyRetryPeriod passed.
+	d.do(func() { d.validatePeers(ih, responder, []string{p}) })
+	if n := calls.Load(); n != 1 {
+		t.Errorf("the rejected peer was checked %d times, wanted 1", n)
+	}
+	d.do(func() {
+		v, _ := d.peerCandidates.Get(string(ih))
+		v.(map[string]*peerCandidate)[p].rejected = time.Now().Add(-peerVerifyRetryPeriod)
+		d.validatePeers(ih, responder, []string{p})
+	})
+	select {
+	case r := <-d.PeersRequestResults:
+		if peers := r[ih]; len(peers) != 1 || peers[0] != p {
+			t.Errorf("got peers %q, wanted the approved one", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the peer was not approved when checked again")
+	}
+}
+
+func TestPeerVerifierStop(t *testing.T) {
+	ih := testInfoHash
+	p := "\x01\x02\x03\x04\x1a\xe1"
+	started, release := make(chan bool), make(chan bool)
+	d := newTestDHT(t, func(c *Config) {
+		c.PeerVerifier = verifierFunc(func(util.InfoHash, string) bool {
+			started <- true
+			<-release
+			return true
+		})
+	})
+	if err := d.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	responder := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	d.do(func() { d.validatePeers(ih, responder, []string{p}) })
+	<-started
+	stopped := make(chan bool)
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("Stop returned while the peer was being checked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+	// The check finished after Stop, its result is dropped.
+	if n := d.peerStore.Count(ih); n != 0 {
+		t.Errorf("peer store has %d peers after Stop, wanted 0", n)
+	}
+}
+
+type verifierFunc func(ih util.InfoHash, peerContact string) bool
+
+func (f verifierFunc) VerifyPeer(ih util.InfoHash, peerContact string) bool {
+	return f(ih, peerContact)
+}
@@ -22,6 +22,10 @@ type QueryType struct {
 	Type    string
 	IH      util.InfoHash
 	srcNode string
+	// When the query was sent.
+	SentTime time.Time
+	// Failed is set once the query timed out.
+	Failed bool
 }
 
 const (
@@ -67,29 +71,32 @@ func ParseNodesString(nodes string, proto string, log logger.DebugLogger) (parse
 
 type GetPeersResponse struct {
 	// TODO: argh, values can be a string depending on the client (e.g: original bittorrent).
-	Values []string "values"
-	Id     string   "id"
-	Nodes  string   "nodes"
-	Nodes6 string   "nodes6"
-	Token  string   "token"
+	Values []string `bencode:"values"`
+	Id     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes"`
+	Nodes6 string   `bencode:"nodes6"`
+	Token  string   `bencode:"token"`
 }
 
 type AnswerType struct {
-	Id       string        "id"
-	Target   string        "target"
-	InfoHash util.InfoHash "info_hash" // should probably be a string.
-	Port     int           "port"
-	Token    string        "token"
+	Id       string        `bencode:"id"`
+	Target   string        `bencode:"target"`
+	InfoHash util.InfoHash `bencode:"info_hash"` // should probably be a string.
+	Port     int           `bencode:"port"`
+	// If non-zero, the announced port is the source port of the query
+	// (BEP 5).
+	ImpliedPort int    `bencode:"implied_port"`
+	Token       string `bencode:"token"`
 }
 
 // Generic stuff we read from the wire, not knowing what it is. This is as generic as can be.
 type ResponseType struct {
-	T string           "t"
-	Y string           "y"
-	Q string           "q"
-	R GetPeersResponse "r"
-	E []string         "e"
-	A AnswerType       "a"
+	T string           `bencode:"t"`
+	Y string           `bencode:"y"`
+	Q string           `bencode:"q"`
+	R GetPeersResponse `bencode:"r"`
+	E []string         `bencode:"e"`
+	A AnswerType       `bencode:"a"`
 	// Unsupported mainline extension for client identification.
 	// V string(?)	"v"
 }
@@ -127,16 +134,16 @@ func ReadResponse(p PacketType, log logger.DebugLogger) (response ResponseType,
 
 // Message to be sent out in the wire. Must not have any extra fields.
 type QueryMessage struct {
-	T string                 "t"
-	Y string                 "y"
-	Q string                 "q"
-	A map[string]interface{} "a"
+	T string                 `bencode:"t"`
+	Y string                 `bencode:"y"`
+	Q string                 `bencode:"q"`
+	A map[string]interface{} `bencode:"a"`
 }
 
 type ReplyMessage struct {
-	T string                 "t"
-	Y string                 "y"
-	R map[string]interface{} "r"
+	T string                 `bencode:"t"`
+	Y string                 `bencode:"y"`
+	R map[string]interface{} `bencode:"r"`
 }
 
 type PacketType struct {
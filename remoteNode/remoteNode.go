@@ -25,11 +25,44 @@ type RemoteNode struct {
 	PastQueries      map[string]*QueryType // key: transaction ID
 	Reachable        bool
 	LastResponseTime time.Time
-	LastSearchTime   time.Time
-	ActiveDownloads  []string // List of util.InfoHashes we know this peer is downloading.
-	Log              *logger.DebugLogger
+	// LastQueryTime is when the node last sent us a query.
+	LastQueryTime   time.Time
+	LastSearchTime  time.Time
+	ActiveDownloads []string // List of util.InfoHashes we know this peer is downloading.
+	Log             *logger.DebugLogger
+	// Honest nodes were added explicitly by the user, and are exempt from
+	// the routing table diversity limits.
+	Honest bool
+	// Round-trip time estimates, as in TCP (RFC 6298). Zero until the
+	// first reply.
+	SRTT   time.Duration
+	RTTVar time.Duration
+	// Number of replies received, and of queries that timed out.
+	Replies  int
+	Failures int
+	// Queries that timed out since the last reply, see ExpireQueries.
+	failed int
+	// Source is how we learned about the node, one of the Source*
+	// constants.
+	Source string
 }
 
+// Ways we learn about nodes, for RemoteNode.Source.
+const (
+	// A configured bootstrap router.
+	SourceRouter = "router"
+	// Added with DHT.AddNode, or loaded from the saved routing table.
+	SourceAdded = "added"
+	// Added with DHT.ADDHonestPeer.
+	SourceHonest = "honest"
+	// The node sent us a query.
+	SourceQuery = "query"
+	// The node replied to us from an address we didn't know.
+	SourceReply = "reply"
+	// Another node returned it in a find_node or get_peers reply.
+	SourceLookup = "lookup"
+)
+
 func NewRemoteNode(addr net.UDPAddr, id string, log *logger.DebugLogger) *RemoteNode {
 	return &RemoteNode{
 		Address:             addr,
@@ -51,10 +84,155 @@ func (r *RemoteNode) NewQuery(transType string) (transId string) {
 	r.LastQueryID = (r.LastQueryID + 1) % 256
 	transId = strconv.Itoa(r.LastQueryID)
 	(*r.Log).Debugf("... new id %v", r.LastQueryID)
-	r.PendingQueries[transId] = &QueryType{Type: transType}
+	r.PendingQueries[transId] = &QueryType{Type: transType, SentTime: time.Now()}
 	return
 }
 
+// Node states, as defined in BEP 5.
+type NodeState int
+
+const (
+	// The node hasn't been heard from recently.
+	NodeQuestionable NodeState = iota
+	// The node replied to us, or queried us after having replied before,
+	// within GoodNodePeriod.
+	NodeGood
+	// The node failed to reply to MaxFailedQueries queries in a row.
+	NodeBad
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeGood:
+		return "good"
+	case NodeBad:
+		return "bad"
+	}
+	return "questionable"
+}
+
+var (
+	// GoodNodePeriod is how long a node stays good after it was last heard
+	// from.
+	GoodNodePeriod = 15 * time.Minute
+	// QueryTimeout is how long to wait for a reply before a query is
+	// considered failed, for nodes without RTT estimates. It's also the
+	// upper bound for the adaptive timeouts.
+	QueryTimeout = 30 * time.Second
+	// MinQueryTimeout is the lower bound for the adaptive timeouts.
+	MinQueryTimeout = time.Second
+	// MaxFailedQueries is how many queries in a row a node can fail before
+	// it is considered bad.
+	MaxFailedQueries = 3
+	// MaxQueryAge is how long a query stays pending. Replies that arrive
+	// after it timed out but before this are still processed.
+	MaxQueryAge = 2 * QueryTimeout
+)
+
+// Replied records a reply to query q, updating the RTT estimates.
+func (r *RemoteNode) Replied(q *QueryType) {
+	r.Replies++
+	r.failed = 0
+	if q.Failed {
+		// It was just slow.
+		q.Failed = false
+		r.Failures--
+	}
+	if q.SentTime.IsZero() {
+		return
+	}
+	rtt := time.Since(q.SentTime)
+	if r.SRTT == 0 {
+		r.SRTT = rtt
+		r.RTTVar = rtt / 2
+		return
+	}
+	d := r.SRTT - rtt
+	if d < 0 {
+		d = -d
+	}
+	r.RTTVar = (3*r.RTTVar + d) / 4
+	r.SRTT = (7*r.SRTT + rtt) / 8
+}
+
+// Timeout returns how long to wait for a reply from r, derived from its RTT
+// estimates like the TCP retransmission timeout. As in TCP, it doubles after
+// each query that timed out, until the next reply.
+func (r *RemoteNode) Timeout() time.Duration {
+	if r.SRTT == 0 {
+		return QueryTimeout
+	}
+	t := r.SRTT + 4*r.RTTVar
+	if t < MinQueryTimeout {
+		t = MinQueryTimeout
+	}
+	for i := 0; i < r.failed && t < QueryTimeout; i++ {
+		t *= 2
+	}
+	if t > QueryTimeout {
+		return QueryTimeout
+	}
+	return t
+}
+
+// ExpireQueries marks the pending queries that got no reply within Timeout
+// as failed, and returns them. Queries older than MaxQueryAge are forgotten.
+// Failures are only detected here, so the owner of r must call it
+// periodically.
+func (r *RemoteNode) ExpireQueries(now time.Time) (failed []*QueryType) {
+	timeout := r.Timeout()
+	for id, q := range r.PendingQueries {
+		if q.SentTime.IsZero() {
+			continue
+		}
+		age := now.Sub(q.SentTime)
+		if !q.Failed && age > timeout {
+			q.Failed = true
+			r.Failures++
+			if q.SentTime.After(r.LastResponseTime) {
+				r.failed++
+			}
+			failed = append(failed, q)
+		}
+		if age > MaxQueryAge {
+			delete(r.PendingQueries, id)
+		}
+	}
+	return failed
+}
+
+// Reliability estimates the probability that r replies to a query.
+func (r *RemoteNode) Reliability() float64 {
+	return float64(r.Replies+1) / float64(r.Replies+r.Failures+2)
+}
+
+// Cost estimates how long it takes to get a reply from r, taking failures
+// into account. Lower is better.
+func (r *RemoteNode) Cost() time.Duration {
+	rtt := r.SRTT
+	if rtt == 0 {
+		rtt = QueryTimeout / 2
+	}
+	return time.Duration(float64(rtt) / r.Reliability())
+}
+
+// FailedQueries returns the number of queries sent since the last reply
+// from r that ExpireQueries found to have timed out.
+func (r *RemoteNode) FailedQueries() int {
+	return r.failed
+}
+
+// State returns the BEP 5 state of r.
+func (r *RemoteNode) State() NodeState {
+	if r.FailedQueries() >= MaxFailedQueries {
+		return NodeBad
+	}
+	if r.Reachable && (time.Since(r.LastResponseTime) < GoodNodePeriod || time.Since(r.LastQueryTime) < GoodNodePeriod) {
+		return NodeGood
+	}
+	return NodeQuestionable
+}
+
 // wasContactedRecently returns true if a node was contacted recently _and_
 // one of the recent queries (not necessarily the last) was about the ih. If
 // the ih is different at each time, it will keep returning false.
@@ -0,0 +1,94 @@
+package remoteNode
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"dht/logger"
+)
+
+func TestNodeState(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewRemoteNode(net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1111}, "01abcdefghij01234567", &log)
+	if s := r.State(); s != NodeQuestionable {
+		t.Errorf("new node is %v, wanted questionable", s)
+	}
+	r.Reachable = true
+	r.LastResponseTime = time.Now()
+	if s := r.State(); s != NodeGood {
+		t.Errorf("node that just replied is %v, wanted good", s)
+	}
+	r.LastResponseTime = time.Now().Add(-GoodNodePeriod - time.Minute)
+	if s := r.State(); s != NodeQuestionable {
+		t.Errorf("node not seen for a while is %v, wanted questionable", s)
+	}
+	r.LastQueryTime = time.Now()
+	if s := r.State(); s != NodeGood {
+		t.Errorf("node that just queried us is %v, wanted good", s)
+	}
+	for i := 0; i < MaxFailedQueries; i++ {
+		r.PendingQueries[r.NewQuery("ping")].SentTime = time.Now().Add(-QueryTimeout - time.Second)
+	}
+	if s := r.State(); s != NodeGood {
+		t.Errorf("node is %v before its queries were expired, wanted good", s)
+	}
+	if failed := r.ExpireQueries(time.Now()); len(failed) != MaxFailedQueries {
+		t.Errorf("ExpireQueries returned %d queries, wanted %d", len(failed), MaxFailedQueries)
+	}
+	if s := r.State(); s != NodeBad {
+		t.Errorf("node that failed %d queries is %v, wanted bad", MaxFailedQueries, s)
+	}
+	if len(r.PendingQueries) != MaxFailedQueries {
+		t.Errorf("%d pending queries, wanted them kept until MaxQueryAge", len(r.PendingQueries))
+	}
+	r.ExpireQueries(time.Now().Add(MaxQueryAge))
+	if len(r.PendingQueries) != 0 || r.Failures != MaxFailedQueries {
+		t.Errorf("%d pending queries and %d failures after MaxQueryAge, wanted 0 and %d", len(r.PendingQueries), r.Failures, MaxFailedQueries)
+	}
+	r.Replied(&QueryType{})
+	if n := r.FailedQueries(); n != 0 {
+		t.Errorf("%d failed queries after a reply, wanted 0", n)
+	}
+}
+
+func TestRTT(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewRemoteNode(net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1111}, "01abcdefghij01234567", &log)
+	if got := r.Timeout(); got != QueryTimeout {
+		t.Errorf("Timeout without samples = %v, wanted %v", got, QueryTimeout)
+	}
+	for i := 0; i < 20; i++ {
+		r.Replied(&QueryType{SentTime: time.Now().Add(-2 * time.Second)})
+	}
+	if r.SRTT < 2*time.Second || r.SRTT > 3*time.Second {
+		t.Errorf("SRTT = %v, wanted about 2s", r.SRTT)
+	}
+	if got := r.Timeout(); got < r.SRTT || got >= QueryTimeout {
+		t.Errorf("Timeout = %v with SRTT %v", got, r.SRTT)
+	}
+	// A query that takes longer than the timeout fails, unless a reply
+	// arrives later.
+	q := r.PendingQueries[r.NewQuery("ping")]
+	timeout := r.Timeout()
+	q.SentTime = time.Now().Add(-timeout - time.Second)
+	r.LastResponseTime = q.SentTime.Add(-time.Second)
+	r.ExpireQueries(time.Now())
+	if n := r.FailedQueries(); n != 1 || r.Failures != 1 {
+		t.Errorf("FailedQueries = %d, Failures = %d; wanted 1, 1", n, r.Failures)
+	}
+	if got := r.Timeout(); got != 2*timeout && got != QueryTimeout {
+		t.Errorf("Timeout = %v after a failure, wanted it doubled from %v", got, timeout)
+	}
+	if rel := r.Reliability(); rel >= 1 || rel <= 0.5 {
+		t.Errorf("Reliability = %v after 20 replies and a failure", rel)
+	}
+	r.Replied(q)
+	if r.Failures != 0 {
+		t.Errorf("Failures = %d after a late reply, wanted 0", r.Failures)
+	}
+	// The late reply raises the estimates, but the doubling is over.
+	if got := r.Timeout(); got >= 2*timeout {
+		t.Errorf("Timeout = %v after a reply, wanted less than %v", got, 2*timeout)
+	}
+}
@@ -0,0 +1,115 @@
+package routingTable
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// DiversityLimits caps how many nodes in the table may share an IP address or
+// a subnet (/24 for IPv4, /64 for IPv6), so that a single host can't fill the
+// table, or our neighborhood, with nodes listening on many ports. Zero means
+// no limit. Honest nodes are exempt.
+type DiversityLimits struct {
+	// Limits for the whole table.
+	PerIP     int
+	PerSubnet int
+	// Limits for the util.KNodes nodes closest to our own ID.
+	NeighborhoodPerIP     int
+	NeighborhoodPerSubnet int
+	// If set, nodes on loopback addresses are exempt too, so that several
+	// local nodes can be run for testing. Set it before adding nodes.
+	ExemptLoopback bool
+}
+
+// diversityExempt returns true if n is not subject to the diversity limits.
+func (r *RoutingTable) diversityExempt(n *remoteNode.RemoteNode) bool {
+	return n.Honest || r.DiversityLimits.ExemptLoopback && n.Address.IP.IsLoopback()
+}
+
+// checkDiversity returns an error if adding n would exceed the diversity
+// limits.
+func (r *RoutingTable) checkDiversity(n *remoteNode.RemoteNode) error {
+	if r.diversityExempt(n) {
+		return nil
+	}
+	ip, subnet := n.Address.IP.String(), util.Subnet(n.Address.IP)
+	l := r.DiversityLimits
+	if l.PerIP > 0 && r.ipCount[ip] >= l.PerIP {
+		return r.rejectDiversity("ip", n)
+	}
+	if l.PerSubnet > 0 && r.subnetCount[subnet] >= l.PerSubnet {
+		return r.rejectDiversity("subnet", n)
+	}
+	return r.checkNeighborhoodDiversity(n)
+}
+
+// checkNeighborhoodDiversity returns an error if n would become one of our
+// closest neighbors, and that would exceed the neighborhood diversity limits.
+func (r *RoutingTable) checkNeighborhoodDiversity(n *remoteNode.RemoteNode) error {
+	l := r.DiversityLimits
+	if r.diversityExempt(n) || l.NeighborhoodPerIP <= 0 && l.NeighborhoodPerSubnet <= 0 {
+		return nil
+	}
+	if remoteNode.BogusId(n.ID) || len(r.NodeID) != len(n.ID) {
+		// Nodes with unknown IDs are not in the neighborhood. They are
+		// checked again when their ID is learned.
+		return nil
+	}
+	neighbors := r.nodeIndex.Lookup(util.InfoHash(r.NodeID))
+	if len(neighbors) == util.KNodes &&
+		bytes.Compare(xor(n.ID, r.NodeID), xor(neighbors[len(neighbors)-1].ID, r.NodeID)) >= 0 {
+		// Not closer than our current neighbors.
+		return nil
+	}
+	subnet := util.Subnet(n.Address.IP)
+	sameIP, sameSubnet := 0, 0
+	for _, m := range neighbors {
+		if m.ID == n.ID || r.diversityExempt(m) {
+			continue
+		}
+		if m.Address.IP.Equal(n.Address.IP) {
+			sameIP++
+		}
+		if util.Subnet(m.Address.IP) == subnet {
+			sameSubnet++
+		}
+	}
+	if l.NeighborhoodPerIP > 0 && sameIP >= l.NeighborhoodPerIP {
+		return r.rejectDiversity("neighborhood ip", n)
+	}
+	if l.NeighborhoodPerSubnet > 0 && sameSubnet >= l.NeighborhoodPerSubnet {
+		return r.rejectDiversity("neighborhood subnet", n)
+	}
+	return nil
+}
+
+func (r *RoutingTable) rejectDiversity(limit string, n *remoteNode.RemoteNode) error {
+	totalDiversityRejections.Add(limit, 1)
+	return fmt.Errorf("routingTable: too many nodes from the same %s as %v", limit, n.Address.String())
+}
+
+// countDiversity updates the per IP and per subnet node counts by delta.
+func (r *RoutingTable) countDiversity(n *remoteNode.RemoteNode, delta int) {
+	if r.diversityExempt(n) {
+		return
+	}
+	if r.ipCount == nil {
+		r.ipCount = make(map[string]int)
+		r.subnetCount = make(map[string]int)
+	}
+	ip, subnet := n.Address.IP.String(), util.Subnet(n.Address.IP)
+	if r.ipCount[ip] += delta; r.ipCount[ip] <= 0 {
+		delete(r.ipCount, ip)
+	}
+	if r.subnetCount[subnet] += delta; r.subnetCount[subnet] <= 0 {
+		delete(r.subnetCount, subnet)
+	}
+}
+
+// totalDiversityRejections counts the nodes rejected by the diversity limits,
+// by limit.
+var totalDiversityRejections = expvar.NewMap("totalDiversityRejections")
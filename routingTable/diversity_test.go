@@ -0,0 +1,90 @@
+package routingTable
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"dht/logger"
+	"dht/peer"
+	"dht/remoteNode"
+)
+
+func TestDiversityLimits(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewRoutingTable(&log)
+	r.SetNodeID(randID(t))
+	r.DiversityLimits = DiversityLimits{PerIP: 2, PerSubnet: 3}
+	add := func(hostPort string) error {
+		_, err := r.GetOrCreateNode(randID(t), hostPort, "udp4")
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := add(fmt.Sprintf("1.2.3.4:%d", 1000+i)); err != nil {
+			t.Fatalf("node %d rejected: %v", i, err)
+		}
+	}
+	if err := add("1.2.3.4:1002"); err == nil {
+		t.Fatalf("third node on the same IP accepted")
+	}
+	if err := add("1.2.3.5:1000"); err != nil {
+		t.Fatalf("node on another IP rejected: %v", err)
+	}
+	if err := add("1.2.3.6:1000"); err == nil {
+		t.Fatalf("fourth node on the same subnet accepted")
+	}
+	// Loopback addresses are only exempt if configured.
+	if err := add("127.0.0.1:1000"); err != nil {
+		t.Fatalf("loopback node rejected: %v", err)
+	}
+	if err := add("127.0.0.1:1001"); err != nil {
+		t.Fatalf("second loopback node rejected: %v", err)
+	}
+	if err := add("127.0.0.1:1002"); err == nil {
+		t.Fatalf("third loopback node accepted without ExemptLoopback")
+	}
+	r.DiversityLimits.ExemptLoopback = true
+	if err := add("127.0.0.2:1000"); err != nil {
+		t.Fatalf("loopback node rejected with ExemptLoopback: %v", err)
+	}
+	// Honest nodes are exempt.
+	honest := remoteNode.NewRemoteNode(net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2000}, randID(t), &log)
+	honest.Honest = true
+	if err := r.Insert(honest, "udp4"); err != nil {
+		t.Fatalf("honest node rejected: %v", err)
+	}
+	// Killed nodes free their slot.
+	n, _, _, _ := r.HostPortToNode("1.2.3.4:1000", "udp4")
+	r.Kill(n, peer.NewMemoryPeerStore(1, 1))
+	if err := add("1.2.3.4:1003"); err != nil {
+		t.Fatalf("node rejected after another on the same IP was killed: %v", err)
+	}
+}
+
+func TestNeighborhoodDiversityLimits(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewKBucketRoutingTable(randID(t), &log)
+	r.DiversityLimits = DiversityLimits{NeighborhoodPerIP: 1}
+	// Close to our ID, so they'd be our neighbors.
+	close := func() string {
+		return randIDInRegion(t, r.NodeID, 100)
+	}
+	if _, err := r.GetOrCreateNode(close(), "1.2.3.4:1000", "udp4"); err != nil {
+		t.Fatalf("first neighbor rejected: %v", err)
+	}
+	if _, err := r.GetOrCreateNode(close(), "1.2.3.4:1001", "udp4"); err == nil {
+		t.Fatalf("second neighbor on the same IP accepted")
+	}
+	if _, err := r.GetOrCreateNode(close(), "1.2.3.5:1000", "udp4"); err != nil {
+		t.Fatalf("neighbor on another IP rejected: %v", err)
+	}
+	// Nodes with unknown IDs are checked when their ID is learned.
+	n, err := r.GetOrCreateNode("", "1.2.3.5:1001", "udp4")
+	if err != nil {
+		t.Fatalf("node with unknown ID rejected: %v", err)
+	}
+	n.ID = close()
+	if err := r.Update(n, "udp4"); err == nil {
+		t.Fatalf("Update accepted a second neighbor on the same IP")
+	}
+}
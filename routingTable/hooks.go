@@ -0,0 +1,48 @@
+package routingTable
+
+import (
+	"net"
+
+	"dht/remoteNode"
+)
+
+// Reasons for a node removal, as reported in NodeEvent.Reason.
+const (
+	// Removed by an explicit Kill call.
+	ReasonKilled = "killed"
+	// Displaced from the neighborhood by a closer node.
+	ReasonDisplaced = "displaced"
+	// Replaced in a full bucket by a newcomer.
+	ReasonReplaced = "replaced"
+	// The node address stored in the table was inconsistent.
+	ReasonBadAddress = "bad address"
+	// Went bad: stopped replying to our queries.
+	ReasonStale = "stale"
+	// Never replied to our queries.
+	ReasonUnreachable = "unreachable"
+)
+
+// NodeEvent describes a change of a node in the routing table.
+type NodeEvent struct {
+	ID      string
+	Address net.UDPAddr
+	// Reason is empty for additions.
+	Reason string
+}
+
+// Hooks receives routing table events. Methods are called synchronously,
+// from the goroutine that changed the table.
+type Hooks interface {
+	// NodeAdded is called when a node is inserted in the table.
+	NodeAdded(e NodeEvent)
+	// NodeRemoved is called when a node is removed from the table by
+	// Kill or Cleanup.
+	NodeRemoved(e NodeEvent)
+	// NodeEvicted is called when a node is removed to make room for
+	// another one.
+	NodeEvicted(e NodeEvent)
+}
+
+func nodeEvent(n *remoteNode.RemoteNode, reason string) NodeEvent {
+	return NodeEvent{ID: n.ID, Address: n.Address, Reason: reason}
+}
@@ -0,0 +1,219 @@
+package routingTable
+
+import (
+	"bytes"
+	"sort"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// nodeIndex is the structure that keeps the nodes with known IDs, ordered so
+// that the closest ones to a target can be found quickly. RoutingTable keeps
+// the address map and the neighborhood on top of it.
+type nodeIndex interface {
+	// Add inserts r, replacing any node with the same ID. If there's no
+	// room for it, ok is false. If another node had to be dropped to make
+	// room, it is returned in evicted.
+	Add(r *remoteNode.RemoteNode) (evicted *remoteNode.RemoteNode, ok bool)
+	// Remove deletes the node with the given ID.
+	Remove(ID util.InfoHash)
+	// Seen is called when r replied to a query.
+	Seen(r *remoteNode.RemoteNode)
+	// Lookup returns the closest util.KNodes nodes to ID, closest first.
+	Lookup(ID util.InfoHash) []*remoteNode.RemoteNode
+	// LookupFiltered is like Lookup but skips nodes that shouldn't be
+	// queried about ID right now.
+	LookupFiltered(ID util.InfoHash) []*remoteNode.RemoteNode
+}
+
+// kTable is a standard Kademlia routing table, as described in BEP 5. Bucket
+// i holds up to util.KNodes nodes that share exactly i prefix bits with our
+// own ID, except for the last bucket, which holds all nodes sharing more
+// bits than that. Only the last bucket, the one that contains our own ID, is
+// ever split.
+//
+// Nodes in a bucket are ordered from least to most recently seen. When a
+// bucket is full, a newcomer only gets in by replacing the least recently
+// seen node, and only if that node is not reachable or went bad. Otherwise
+// the newcomer is rejected, since nodes that have been around for a long
+// time are likely to stay.
+type kTable struct {
+	ownID   string
+	buckets []*kBucket
+}
+
+type kBucket struct {
+	nodes []*remoteNode.RemoteNode
+}
+
+func newKTable(ownID string) *kTable {
+	return &kTable{ownID: ownID, buckets: []*kBucket{{}}}
+}
+
+// bucketIndex returns the index of the bucket that covers ID.
+func (t *kTable) bucketIndex(ID string) int {
+	i := CommonBits(t.ownID, ID)
+	if i >= len(t.buckets) {
+		return len(t.buckets) - 1
+	}
+	return i
+}
+
+func (b *kBucket) find(ID string) int {
+	for i, n := range b.nodes {
+		if n.ID == ID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *kBucket) remove(i int) *remoteNode.RemoteNode {
+	n := b.nodes[i]
+	b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+	return n
+}
+
+func (t *kTable) Add(r *remoteNode.RemoteNode) (evicted *remoteNode.RemoteNode, ok bool) {
+	if len(r.ID) != 20 || len(t.ownID) != 20 || r.ID == t.ownID {
+		return nil, false
+	}
+	for {
+		i := t.bucketIndex(r.ID)
+		b := t.buckets[i]
+		if j := b.find(r.ID); j >= 0 {
+			// Replace and move to the most recently seen position.
+			b.remove(j)
+			b.nodes = append(b.nodes, r)
+			return nil, true
+		}
+		if len(b.nodes) < util.KNodes {
+			b.nodes = append(b.nodes, r)
+			return nil, true
+		}
+		if i == len(t.buckets)-1 && len(t.buckets) < len(t.ownID)*8 {
+			t.split()
+			continue
+		}
+		if lrs := b.nodes[0]; !lrs.Honest && (!lrs.Reachable || lrs.State() == remoteNode.NodeBad || len(lrs.PendingQueries) > util.MaxNodePendingQueries) {
+			b.remove(0)
+			b.nodes = append(b.nodes, r)
+			return lrs, true
+		}
+		if r.Honest {
+			// Trusted nodes are pinned, so they take the place of the
+			// least recently seen untrusted node.
+			for j, n := range b.nodes {
+				if !n.Honest {
+					b.remove(j)
+					b.nodes = append(b.nodes, r)
+					return n, true
+				}
+			}
+		}
+		return nil, false
+	}
+}
+
+// split moves the nodes in the last bucket that share more prefix bits with
+// our ID into a new last bucket.
+func (t *kTable) split() {
+	last := t.buckets[len(t.buckets)-1]
+	next := &kBucket{}
+	t.buckets = append(t.buckets, next)
+	depth := len(t.buckets) - 2
+	kept := last.nodes[:0]
+	for _, n := range last.nodes {
+		if CommonBits(t.ownID, n.ID) > depth {
+			next.nodes = append(next.nodes, n)
+		} else {
+			kept = append(kept, n)
+		}
+	}
+	last.nodes = kept
+}
+
+func (t *kTable) Remove(ID util.InfoHash) {
+	if len(ID) != 20 {
+		return
+	}
+	b := t.buckets[t.bucketIndex(string(ID))]
+	if j := b.find(string(ID)); j >= 0 {
+		b.remove(j)
+	}
+}
+
+func (t *kTable) Seen(r *remoteNode.RemoteNode) {
+	if len(r.ID) != 20 {
+		return
+	}
+	b := t.buckets[t.bucketIndex(r.ID)]
+	if j := b.find(r.ID); j >= 0 {
+		n := b.remove(j)
+		b.nodes = append(b.nodes, n)
+	}
+}
+
+func (t *kTable) Lookup(ID util.InfoHash) []*remoteNode.RemoteNode {
+	return t.lookup(ID, false)
+}
+
+func (t *kTable) LookupFiltered(ID util.InfoHash) []*remoteNode.RemoteNode {
+	return t.lookup(ID, true)
+}
+
+// lookup visits the buckets in order of distance to ID. If c is the number
+// of prefix bits shared by our ID and the target, nodes in bucket c share
+// more than c bits with the target, nodes in further buckets share exactly
+// c bits, and nodes in bucket i < c share exactly i bits. So buckets are
+// collected in groups, and only nodes within a group need to be sorted.
+func (t *kTable) lookup(ID util.InfoHash, filter bool) []*remoteNode.RemoteNode {
+	if len(ID) != 20 {
+		return nil
+	}
+	ret := make([]*remoteNode.RemoteNode, 0, util.KNodes)
+	c := t.bucketIndex(string(ID))
+	ret = t.collect(ID, filter, ret, t.buckets[c:c+1])
+	if c < len(t.buckets)-1 {
+		ret = t.collect(ID, filter, ret, t.buckets[c+1:])
+	}
+	for i := c - 1; i >= 0 && len(ret) < util.KNodes; i-- {
+		ret = t.collect(ID, filter, ret, t.buckets[i:i+1])
+	}
+	return ret
+}
+
+// collect appends the nodes in buckets to ret, closest to ID first, until ret
+// has util.KNodes nodes.
+func (t *kTable) collect(ID util.InfoHash, filter bool, ret []*remoteNode.RemoteNode, buckets []*kBucket) []*remoteNode.RemoteNode {
+	if len(ret) >= util.KNodes {
+		return ret
+	}
+	var group []*remoteNode.RemoteNode
+	for _, b := range buckets {
+		for _, n := range b.nodes {
+			if !filter || isOK(n, ID) {
+				group = append(group, n)
+			}
+		}
+	}
+	sort.Slice(group, func(i, j int) bool {
+		return bytes.Compare(xor(group[i].ID, string(ID)), xor(group[j].ID, string(ID))) < 0
+	})
+	for _, n := range group {
+		if len(ret) >= util.KNodes {
+			break
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+func xor(a, b string) []byte {
+	d := make([]byte, len(a))
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
@@ -0,0 +1,141 @@
+package routingTable
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sort"
+	"testing"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+func randID(t testing.TB) string {
+	b, err := remoteNode.RandNodeId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func (t *kTable) all() []*remoteNode.RemoteNode {
+	var ret []*remoteNode.RemoteNode
+	for _, b := range t.buckets {
+		ret = append(ret, b.nodes...)
+	}
+	return ret
+}
+
+func TestKTableLookup(t *testing.T) {
+	tbl := newKTable(randID(t))
+	for i := 0; i < 1000; i++ {
+		tbl.Add(&remoteNode.RemoteNode{ID: randID(t), Reachable: true})
+	}
+	for i, b := range tbl.buckets {
+		if len(b.nodes) > util.KNodes {
+			t.Errorf("bucket %d has %d nodes", i, len(b.nodes))
+		}
+	}
+	if len(tbl.buckets) < 2 {
+		t.Fatalf("own bucket never split")
+	}
+	all := tbl.all()
+	targets := []string{tbl.ownID}
+	for i := 0; i < 50; i++ {
+		targets = append(targets, randID(t))
+	}
+	for _, target := range targets {
+		sort.Slice(all, func(i, j int) bool {
+			return bytes.Compare(xor(all[i].ID, target), xor(all[j].ID, target)) < 0
+		})
+		got := tbl.Lookup(util.InfoHash(target))
+		if len(got) != util.KNodes {
+			t.Fatalf("Lookup(%x) returned %d nodes, wanted %d", target, len(got), util.KNodes)
+		}
+		for i := range got {
+			if got[i] != all[i] {
+				t.Fatalf("Lookup(%x)[%d] = %x, wanted %x", target, i, got[i].ID, all[i].ID)
+			}
+		}
+	}
+}
+
+func TestKTableFullBucket(t *testing.T) {
+	own := "\x00" + randID(t)[1:]
+	tbl := newKTable(own)
+	// Fill the far bucket with nodes whose first bit differs from ours.
+	far := func() *remoteNode.RemoteNode {
+		id := []byte(randID(t))
+		id[0] |= 0x80
+		return &remoteNode.RemoteNode{ID: string(id), Reachable: true}
+	}
+	// Force a split so the far bucket is no longer our own.
+	var near []byte
+	for i := 0; i <= util.KNodes; i++ {
+		near = []byte(randID(t))
+		near[0] &= 0x7f
+		tbl.Add(&remoteNode.RemoteNode{ID: string(near), Reachable: true})
+	}
+	first := far()
+	tbl.Add(first)
+	for i := 1; i < util.KNodes; i++ {
+		tbl.Add(far())
+	}
+	if _, ok := tbl.Add(far()); ok {
+		t.Fatalf("full bucket accepted a node while its nodes are good")
+	}
+	// Seeing the oldest node makes the next one the least recently seen.
+	tbl.Seen(first)
+	second := tbl.buckets[0].nodes[0]
+	second.Reachable = false
+	evicted, ok := tbl.Add(far())
+	if !ok || evicted != second {
+		t.Fatalf("Add = %v, %v; wanted the unreachable node to be replaced", evicted, ok)
+	}
+	tbl.Remove(util.InfoHash(first.ID))
+	for _, n := range tbl.all() {
+		if n == first {
+			t.Fatalf("removed node still in the table")
+		}
+	}
+}
+
+func TestKTableTrustedNode(t *testing.T) {
+	tbl := newKTable("\x00" + randID(t)[1:])
+	far := func(honest bool) *remoteNode.RemoteNode {
+		id := []byte(randID(t))
+		id[0] |= 0x80
+		return &remoteNode.RemoteNode{ID: string(id), Reachable: true, Honest: honest}
+	}
+	for i := 0; i < util.KNodes; i++ {
+		tbl.Add(far(false))
+	}
+	// Trusted nodes take the place of the least recently seen untrusted one.
+	oldest := tbl.buckets[0].nodes[0]
+	evicted, ok := tbl.Add(far(true))
+	if !ok || evicted != oldest {
+		t.Fatalf("Add = %v, %v; wanted the trusted node to replace the oldest one", evicted, ok)
+	}
+	for i := 1; i < util.KNodes; i++ {
+		if _, ok := tbl.Add(far(true)); !ok {
+			t.Fatalf("trusted node %d rejected", i)
+		}
+	}
+	if _, ok := tbl.Add(far(true)); ok {
+		t.Fatalf("bucket full of trusted nodes accepted another one")
+	}
+}
+
+func BenchmarkKTableLookup(b *testing.B) {
+	b.StopTimer()
+	tbl := newKTable(randID(b))
+	for i := 0; i < 10000; i++ {
+		tbl.Add(&remoteNode.RemoteNode{ID: randID(b), Reachable: true})
+	}
+	target := make([]byte, 20)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		rand.Read(target)
+		tbl.Lookup(util.InfoHash(target))
+	}
+}
@@ -0,0 +1,50 @@
+package routingTable
+
+import "dht/remoteNode"
+
+// Rough estimates of the memory used by the table, on 64-bit platforms.
+const (
+	// A node with no queries, with its entries in Addresses and in the
+	// node index.
+	nodeBytes = 512
+	// A node ID. Nodes added without one get it later.
+	idBytes = 20
+	// An entry of PendingQueries or PastQueries.
+	queryBytes = 96
+)
+
+// baseMemory estimates the memory used by n without its queries and
+// downloads. It doesn't change while n is in the table, so it's accounted
+// when n is added and removed, see NodeMemoryUsage.
+func baseMemory(n *remoteNode.RemoteNode) int64 {
+	return int64(nodeBytes + idBytes + len(n.AddressBinaryFormat))
+}
+
+// queryMemory estimates the memory used by the queries and downloads of n.
+func queryMemory(n *remoteNode.RemoteNode) int64 {
+	b := (len(n.PendingQueries) + len(n.PastQueries)) * queryBytes
+	for _, ih := range n.ActiveDownloads {
+		b += 16 + len(ih)
+	}
+	return int64(b)
+}
+
+// MemoryUsage estimates the memory used by the nodes in the table and by the
+// replacement candidates, in bytes.
+func (r *RoutingTable) MemoryUsage() int64 {
+	total := r.memory
+	for _, n := range r.Addresses {
+		total += queryMemory(n)
+	}
+	for _, n := range r.replacementAddrs {
+		total += queryMemory(n)
+	}
+	return total
+}
+
+// NodeMemoryUsage is like MemoryUsage, without the queries and downloads of
+// the nodes. It's kept up to date as nodes are added and removed, so it's
+// cheap enough to check before adding each node.
+func (r *RoutingTable) NodeMemoryUsage() int64 {
+	return r.memory
+}
@@ -0,0 +1,84 @@
+package routingTable
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// Region refresh, as described in BEP 5 for buckets. The time of the last
+// lookup is tracked for each region of the table, and regions that weren't
+// looked up recently are refreshed by looking up a random ID in them. Our
+// tables would otherwise drift towards our own ID, which is the only region
+// that is actively maintained.
+
+// Touch records a lookup of ID, which refreshes its region.
+func (r *RoutingTable) Touch(ID string) {
+	if len(ID) != 20 || len(r.NodeID) != 20 {
+		return
+	}
+	if r.lastLookup == nil {
+		r.lastLookup = make(map[int]time.Time)
+	}
+	r.lastLookup[r.region(ID)] = time.Now()
+}
+
+// RefreshTargets returns a random ID for each region that wasn't looked up
+// in the last period, and marks those regions as refreshed. Only regions up
+// to our neighborhood are considered, since the ones beyond it are mostly
+// empty and are maintained by the neighborhood upkeep. If no random ID can be
+// generated, it returns none and the regions stay stale until the next call.
+func (r *RoutingTable) RefreshTargets(period time.Duration) (targets []string) {
+	if len(r.NodeID) != 20 {
+		return nil
+	}
+	now := time.Now()
+	if r.refreshStart.IsZero() {
+		// Regions that were never looked up are only stale once a
+		// period has passed since we started tracking them.
+		r.refreshStart = now
+	}
+	if r.lastLookup == nil {
+		r.lastLookup = make(map[int]time.Time)
+	}
+	last := r.Proximity
+	if last >= len(r.NodeID)*8 {
+		last = len(r.NodeID)*8 - 1
+	}
+	var stale []int
+	for region := 0; region <= last; region++ {
+		t, ok := r.lastLookup[region]
+		if !ok {
+			t = r.refreshStart
+		}
+		if now.Sub(t) < period {
+			continue
+		}
+		id, err := randomIDInRegion(r.NodeID, region)
+		if err != nil {
+			(*r.Log).Errorf("DHT: skipping region refresh: %v", err)
+			return nil
+		}
+		targets = append(targets, id)
+		stale = append(stale, region)
+	}
+	for _, region := range stale {
+		r.lastLookup[region] = now
+	}
+	return targets
+}
+
+// randomIDInRegion returns a random ID that shares exactly region prefix bits
+// with id.
+func randomIDInRegion(id string, region int) (string, error) {
+	b := make([]byte, len(id))
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	byteIdx, bit := region/8, byte(0x80)>>uint(region%8)
+	copy(b, id[:byteIdx])
+	// Keep the first bits of id in this byte, flip the next one and leave
+	// the rest random.
+	mask := ^(bit<<1 - 1)
+	b[byteIdx] = id[byteIdx]&mask | (^id[byteIdx])&bit | b[byteIdx]&(bit-1)
+	return string(b), nil
+}
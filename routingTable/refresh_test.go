@@ -0,0 +1,52 @@
+package routingTable
+
+import (
+	"testing"
+	"time"
+
+	"dht/logger"
+)
+
+// randIDInRegion returns a random ID that shares exactly region prefix bits
+// with id.
+func randIDInRegion(t testing.TB, id string, region int) string {
+	r, err := randomIDInRegion(id, region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRandomIDInRegion(t *testing.T) {
+	id := randID(t)
+	for region := 0; region < 160; region++ {
+		for i := 0; i < 10; i++ {
+			if got := CommonBits(id, randIDInRegion(t, id, region)); got != region {
+				t.Fatalf("random ID in region %d shares %d bits with our ID", region, got)
+			}
+		}
+	}
+}
+
+func TestRefreshTargets(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewKBucketRoutingTable(randID(t), &log)
+	r.Proximity = 3
+	if got := r.RefreshTargets(time.Minute); len(got) != 0 {
+		t.Fatalf("regions stale right after start: %d targets", len(got))
+	}
+	r.refreshStart = time.Now().Add(-time.Hour)
+	r.Touch(randIDInRegion(t, r.NodeID, 1))
+	got := r.RefreshTargets(time.Minute)
+	if len(got) != 3 {
+		t.Fatalf("got %d refresh targets, wanted 3", len(got))
+	}
+	for i, region := range []int{0, 2, 3} {
+		if c := CommonBits(r.NodeID, got[i]); c != region {
+			t.Errorf("target %d is in region %d, wanted %d", i, c, region)
+		}
+	}
+	if got := r.RefreshTargets(time.Minute); len(got) != 0 {
+		t.Fatalf("refreshed regions still stale: %d targets", len(got))
+	}
+}
@@ -0,0 +1,149 @@
+package routingTable
+
+import (
+	"expvar"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// Replacement cache, as suggested by BEP 5. Nodes that can't be added to the
+// table because it's full are kept as candidates for the region of the table
+// they belong to, which is the number of prefix bits they share with our own
+// ID. Candidates are pinged, and when a node in the same region is removed,
+// the most recently verified candidate takes its place.
+
+// region returns the region of the table that covers ID.
+func (r *RoutingTable) region(ID string) int {
+	if len(r.NodeID) != len(ID) {
+		return 0
+	}
+	return CommonBits(r.NodeID, ID)
+}
+
+// AddReplacement adds n to the replacement cache of its region. n must have a
+// valid ID and not be in the table. If the region already has util.KNodes
+// candidates, an unverified one is dropped first, then the oldest one.
+func (r *RoutingTable) AddReplacement(n *remoteNode.RemoteNode) {
+	if remoteNode.BogusId(n.ID) || n.ID == r.NodeID {
+		return
+	}
+	addr := n.Address.String()
+	if _, ok := r.Addresses[addr]; ok {
+		return
+	}
+	if _, ok := r.replacementAddrs[addr]; ok {
+		return
+	}
+	if r.replacements == nil {
+		r.replacements = make(map[int][]*remoteNode.RemoteNode)
+		r.replacementAddrs = make(map[string]*remoteNode.RemoteNode)
+	}
+	region := r.region(n.ID)
+	if c := r.replacements[region]; len(c) >= util.KNodes {
+		drop := 0
+		for i, m := range c {
+			if !m.Reachable {
+				drop = i
+				break
+			}
+		}
+		r.removeReplacement(c[drop])
+	}
+	r.replacements[region] = append(r.replacements[region], n)
+	r.replacementAddrs[addr] = n
+	r.memory += baseMemory(n)
+}
+
+// Replacement returns the replacement candidate with the given host:port
+// address, or nil.
+func (r *RoutingTable) Replacement(addr string) *remoteNode.RemoteNode {
+	return r.replacementAddrs[addr]
+}
+
+// NumReplacements returns the number of replacement candidates.
+func (r *RoutingTable) NumReplacements() int {
+	return len(r.replacementAddrs)
+}
+
+func (r *RoutingTable) removeReplacement(n *remoteNode.RemoteNode) {
+	addr := n.Address.String()
+	if r.replacementAddrs[addr] != n {
+		return
+	}
+	delete(r.replacementAddrs, addr)
+	r.memory -= baseMemory(n)
+	region := r.region(n.ID)
+	c := r.replacements[region]
+	for i, m := range c {
+		if m == n {
+			c = append(c[:i], c[i+1:]...)
+			break
+		}
+	}
+	if len(c) == 0 {
+		delete(r.replacements, region)
+	} else {
+		r.replacements[region] = c
+	}
+}
+
+// promoteReplacement inserts the most recently verified candidate for the
+// region of ID into the table.
+func (r *RoutingTable) promoteReplacement(ID string) {
+	if remoteNode.BogusId(ID) {
+		return
+	}
+	c := r.replacements[r.region(ID)]
+	var best *remoteNode.RemoteNode
+	for _, n := range c {
+		if n.Reachable && n.State() != remoteNode.NodeBad &&
+			(best == nil || n.LastResponseTime.After(best.LastResponseTime)) {
+			best = n
+		}
+	}
+	if best == nil {
+		return
+	}
+	r.removeReplacement(best)
+	proto := "udp4"
+	if best.Address.IP.To4() == nil {
+		proto = "udp6"
+	}
+	if err := r.Insert(best, proto); err != nil {
+		(*r.Log).Debugf("DHT: failed to promote replacement node %x: %v", best.ID, err)
+		return
+	}
+	totalPromotedReplacements.Add(1)
+}
+
+// cleanupReplacements drops candidates that went bad or never replied, and
+// returns the ones that still need to be verified.
+func (r *RoutingTable) cleanupReplacements() (needPing []*remoteNode.RemoteNode) {
+	for _, n := range r.replacementAddrs {
+		switch {
+		case n.State() == remoteNode.NodeBad,
+			!n.Reachable && len(n.PendingQueries) > util.MaxNodePendingQueries:
+			r.removeReplacement(n)
+		case n.State() != remoteNode.NodeGood:
+			needPing = append(needPing, n)
+		}
+	}
+	return needPing
+}
+
+// resetReplacements reassigns candidates to regions after our ID changed.
+func (r *RoutingTable) resetReplacements() {
+	old := r.replacements
+	for _, n := range r.replacementAddrs {
+		r.memory -= baseMemory(n)
+	}
+	r.replacements, r.replacementAddrs = nil, nil
+	for _, c := range old {
+		for _, n := range c {
+			r.AddReplacement(n)
+		}
+	}
+}
+
+var totalPromotedReplacements = expvar.NewInt("totalPromotedReplacements")
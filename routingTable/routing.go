@@ -51,6 +51,21 @@ func (n *nTree) Insert(newNode *remoteNode.RemoteNode) {
 	n.Put(newNode, 0)
 }
 
+// Add implements nodeIndex. The tree has no capacity limits, so it never
+// rejects or evicts nodes.
+func (n *nTree) Add(newNode *remoteNode.RemoteNode) (evicted *remoteNode.RemoteNode, ok bool) {
+	n.Insert(newNode)
+	return nil, true
+}
+
+func (n *nTree) Remove(ID util.InfoHash) {
+	n.Cut(ID, 0)
+}
+
+// Seen implements nodeIndex. The tree doesn't keep track of node activity.
+func (n *nTree) Seen(r *remoteNode.RemoteNode) {
+}
+
 func (n *nTree) BranchOut(n1, n2 *remoteNode.RemoteNode, i int) {
 	// Since they are branching out it's guaranteed that no other nodes
 	// exist below this branch currently, so just create the respective
@@ -200,10 +215,15 @@ func (n *nTree) Cut(ID util.InfoHash, i int) (cutMe bool) {
 }
 
 func (n *nTree) IsOK(ih util.InfoHash) bool {
-	if n.value == nil || n.value.ID == "" {
+	return isOK(n.value, ih)
+}
+
+// isOK returns true if r can be queried about ih: it isn't overloaded with
+// pending queries and wasn't asked about ih recently.
+func isOK(r *remoteNode.RemoteNode, ih util.InfoHash) bool {
+	if r == nil || r.ID == "" {
 		return false
 	}
-	r := n.value
 
 	if len(r.PendingQueries) > util.MaxNodePendingQueries {
 		return false
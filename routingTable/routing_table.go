@@ -4,6 +4,7 @@ import (
 	"expvar"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"dht/logger"
@@ -12,16 +13,33 @@ import (
 	"dht/util"
 )
 
+// NewRoutingTable creates a routing table backed by a bucketless binary tree.
+// See routing.go.
 func NewRoutingTable(Log *logger.DebugLogger) *RoutingTable {
 	return &RoutingTable{
-		nTree:     &nTree{},
+		nodeIndex: &nTree{},
+		newIndex:  func(string) nodeIndex { return &nTree{} },
 		Addresses: make(map[string]*remoteNode.RemoteNode),
 		Log:       Log,
 	}
 }
 
+// NewKBucketRoutingTable creates a routing table backed by standard Kademlia
+// k-buckets. See kbucket.go. Since buckets are relative to our own ID,
+// nodeID should be set, and later changed using SetNodeID.
+func NewKBucketRoutingTable(nodeID string, Log *logger.DebugLogger) *RoutingTable {
+	return &RoutingTable{
+		nodeIndex: newKTable(nodeID),
+		newIndex:  func(id string) nodeIndex { return newKTable(id) },
+		Addresses: make(map[string]*remoteNode.RemoteNode),
+		NodeID:    nodeID,
+		Log:       Log,
+	}
+}
+
 type RoutingTable struct {
-	*nTree
+	nodeIndex
+	newIndex func(nodeID string) nodeIndex
 	// Addresses is a map of UDP Addresses in host:port format and
 	// remoteNodes. A string is used because it's not possible to create
 	// a map using net.UDPAddr
@@ -35,6 +53,40 @@ type RoutingTable struct {
 	Proximity int
 
 	Log *logger.DebugLogger
+	// Hooks, if set, is notified of nodes added and removed.
+	Hooks Hooks
+	// KeepNodes drops the per-node query history of reachable nodes during
+	// cleanup to save memory. Nodes are kept while they are good or
+	// questionable, and removed once they go bad, like in other tables. Used
+	// by supernodes, which keep large tables.
+	KeepNodes bool
+
+	// Replacement cache, see replacement.go. Keyed by region and by
+	// address.
+	replacements     map[int][]*remoteNode.RemoteNode
+	replacementAddrs map[string]*remoteNode.RemoteNode
+
+	// DiversityLimits caps the number of nodes per IP and subnet, see
+	// diversity.go.
+	DiversityLimits DiversityLimits
+	ipCount         map[string]int
+	subnetCount     map[string]int
+
+	// Trusted nodes by address, see trusted.go.
+	trusted map[string]*remoteNode.RemoteNode
+
+	// Last lookup time per region, see refresh.go.
+	lastLookup   map[int]time.Time
+	refreshStart time.Time
+
+	// Addresses left to check in the current cleanup sweep, see
+	// cleanup.go.
+	cleanupQueue []string
+	cleanupPing  []*remoteNode.RemoteNode
+
+	// Memory used by the nodes in Addresses and replacementAddrs, without
+	// their queries, see memory.go.
+	memory int64
 }
 
 // hostPortToNode finds a node based on the specified hostPort specification,
@@ -90,6 +142,59 @@ func (r *RoutingTable) NumNodes() int {
 	return len(r.Addresses)
 }
 
+// Each calls f for each node in the table until f returns false.
+func (r *RoutingTable) Each(f func(n *remoteNode.RemoteNode) bool) {
+	for _, n := range r.Addresses {
+		if !f(n) {
+			return
+		}
+	}
+}
+
+// ExpireQueries expires the pending queries of the nodes in the table and of
+// the replacement candidates, see RemoteNode.ExpireQueries, and calls failed
+// for each query that just timed out, if it's not nil.
+func (r *RoutingTable) ExpireQueries(now time.Time, failed func(n *remoteNode.RemoteNode, q *remoteNode.QueryType)) {
+	expire := func(n *remoteNode.RemoteNode) {
+		for _, q := range n.ExpireQueries(now) {
+			if failed != nil {
+				failed(n, q)
+			}
+		}
+	}
+	for _, n := range r.Addresses {
+		expire(n)
+	}
+	for _, n := range r.replacementAddrs {
+		expire(n)
+	}
+}
+
+// LookupFiltered returns the closest nodes to ID that can be queried about
+// it. Nodes that share the same number of prefix bits with ID are about
+// equally close, so among them the ones that reply faster and more reliably
+// come first.
+func (r *RoutingTable) LookupFiltered(ID util.InfoHash) []*remoteNode.RemoteNode {
+	nodes := r.nodeIndex.LookupFiltered(ID)
+	if len(ID) != 20 {
+		return nodes
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		ci, cj := CommonBits(nodes[i].ID, string(ID)), CommonBits(nodes[j].ID, string(ID))
+		if ci != cj {
+			return ci > cj
+		}
+		return nodes[i].Cost() < nodes[j].Cost()
+	})
+	return r.preferTrusted(ID, nodes, true)
+}
+
+// Neighborhood returns the boundary node of our neighborhood and its
+// proximity to our ID.
+func (r *RoutingTable) Neighborhood() (boundary *remoteNode.RemoteNode, proximity int) {
+	return r.BoundaryNode, r.Proximity
+}
+
 func IsValIDAddr(addr string) bool {
 	if addr == "" {
 		return false
@@ -114,9 +219,22 @@ func (r *RoutingTable) Update(node *remoteNode.RemoteNode, proto string) error {
 		return fmt.Errorf("node missing from the routing table: %v", node.Address.String())
 	}
 	if node.ID != "" {
-		r.nTree.Insert(node)
-		totalNodes.Add(1)
 		r.Addresses[addr].ID = node.ID
+		if err := r.checkNeighborhoodDiversity(node); err != nil {
+			// Like when the index is full below, it stays in Addresses
+			// but out of the index.
+			return err
+		}
+		evicted, ok := r.nodeIndex.Add(node)
+		if !ok {
+			// The index has no room for it. It stays in Addresses, so its
+			// replies are still processed, but lookups don't return it.
+			return nil
+		}
+		totalNodes.Add(1)
+		if evicted != nil {
+			r.kill(evicted, nil, ReasonReplaced)
+		}
 	}
 	return nil
 }
@@ -141,16 +259,60 @@ func (r *RoutingTable) Insert(node *remoteNode.RemoteNode, proto string) error {
 	if existed {
 		return nil // fmt.Errorf("node already existed in routing table: %v", node.Address.String())
 	}
-	r.Addresses[addr] = node
+	if err := r.checkDiversity(node); err != nil {
+		return err
+	}
+	var evicted *remoteNode.RemoteNode
 	// We don't know the ID of all nodes.
 	if !remoteNode.BogusId(node.ID) {
-		// recursive version of node insertion.
-		r.nTree.Insert(node)
+		var ok bool
+		if evicted, ok = r.nodeIndex.Add(node); !ok {
+			if node.Honest {
+				return fmt.Errorf("routingTable.insert(): no room for trusted node %x, its region of the table is full of trusted nodes", node.ID)
+			}
+			r.AddReplacement(node)
+			return fmt.Errorf("routingTable.insert(): no room for node %x", node.ID)
+		}
 		totalNodes.Add(1)
 	}
+	if c := r.replacementAddrs[addr]; c != nil {
+		r.removeReplacement(c)
+	}
+	r.Addresses[addr] = node
+	r.memory += baseMemory(node)
+	r.countDiversity(node, 1)
+	if node.Honest {
+		r.addTrusted(node)
+	}
+	if r.Hooks != nil {
+		r.Hooks.NodeAdded(nodeEvent(node, ""))
+	}
+	if evicted != nil {
+		r.kill(evicted, nil, ReasonReplaced)
+	}
 	return nil
 }
 
+// SetNodeID changes our own node ID. The neighborhood is recalculated, and
+// if the nodes are organized relative to our ID, the index is rebuilt.
+func (r *RoutingTable) SetNodeID(id string) {
+	if id == r.NodeID {
+		return
+	}
+	r.NodeID = id
+	r.nodeIndex = r.newIndex(id)
+	for _, n := range r.Addresses {
+		if !remoteNode.BogusId(n.ID) {
+			// Nodes that don't fit anymore are kept with unknown IDs
+			// until the next cleanup.
+			r.nodeIndex.Add(n)
+		}
+	}
+	r.resetReplacements()
+	r.lastLookup = nil
+	r.ResetNeighborhoodBoundary()
+}
+
 // getOrCreateNode returns a node for hostPort, which can be an IP:port or
 // Host:port, which will be resolved if possible.  Preferably return an entry
 // that is already in the routing table, but create a new one otherwise, thus
@@ -171,22 +333,47 @@ func (r *RoutingTable) GetOrCreateNode(ID string, hostPort string, proto string)
 	return node, r.Insert(node, proto)
 }
 
-func (r *RoutingTable) Kill(n *remoteNode.RemoteNode, p *peer.PeerStore) {
-	delete(r.Addresses, n.Address.String())
-	r.nTree.Cut(util.InfoHash(n.ID), 0)
+func (r *RoutingTable) Kill(n *remoteNode.RemoteNode, p peer.PeerStore) {
+	r.kill(n, p, ReasonKilled)
+}
+
+func (r *RoutingTable) kill(n *remoteNode.RemoteNode, p peer.PeerStore, reason string) {
+	if addr := n.Address.String(); r.Addresses[addr] == n {
+		delete(r.Addresses, addr)
+		delete(r.trusted, addr)
+		r.memory -= baseMemory(n)
+		r.countDiversity(n, -1)
+	}
+	if reason != ReasonReplaced {
+		// Replaced nodes were already removed from the index.
+		r.nodeIndex.Remove(util.InfoHash(n.ID))
+	}
 	totalKilledNodes.Add(1)
+	if r.Hooks != nil {
+		if reason == ReasonDisplaced || reason == ReasonReplaced {
+			r.Hooks.NodeEvicted(nodeEvent(n, reason))
+		} else {
+			r.Hooks.NodeRemoved(nodeEvent(n, reason))
+		}
+	}
 
+	if reason != ReasonReplaced && reason != ReasonDisplaced {
+		// Fill the hole with a verified candidate, if there's one.
+		r.promoteReplacement(n.ID)
+	}
 	if r.BoundaryNode != nil && n.ID == r.BoundaryNode.ID {
 		r.ResetNeighborhoodBoundary()
 	}
-	p.KillContact(util.BinaryToDottedPort(n.AddressBinaryFormat))
+	if p != nil {
+		p.KillContact(util.BinaryToDottedPort(n.AddressBinaryFormat))
+	}
 }
 
 func (r *RoutingTable) ResetNeighborhoodBoundary() {
 	r.Proximity = 0
 	// Try to find a distant one within the neighborhood and promote it as
 	// the most distant node in the neighborhood.
-	neighbors := r.Lookup(util.InfoHash(r.NodeID))
+	neighbors := r.nodeIndex.Lookup(util.InfoHash(r.NodeID))
 	if len(neighbors) > 0 {
 		r.BoundaryNode = neighbors[len(neighbors)-1]
 		r.Proximity = CommonBits(r.NodeID, r.BoundaryNode.ID)
@@ -194,60 +381,10 @@ func (r *RoutingTable) ResetNeighborhoodBoundary() {
 
 }
 
-func (r *RoutingTable) Cleanup(cleanupPeriod time.Duration, p *peer.PeerStore) (needPing []*remoteNode.RemoteNode) {
-	needPing = make([]*remoteNode.RemoteNode, 0, 10)
-	t0 := time.Now()
-	// Needs some serious optimization.
-	for addr, n := range r.Addresses {
-		if addr != n.Address.String() {
-			(*r.Log).Debugf("cleanup: node Address mismatches: %v != %v. Deleting node", addr, n.Address.String())
-			r.Kill(n, p)
-			continue
-		}
-		if addr == "" {
-			(*r.Log).Debugf("cleanup: found empty Address for node %x. Deleting node", n.ID)
-			r.Kill(n, p)
-			continue
-		}
-		if n.Reachable {
-			if len(n.PendingQueries) == 0 {
-				goto PING
-			}
-			// Tolerate 2 cleanup cycles.
-			if time.Since(n.LastResponseTime) > cleanupPeriod*2+(cleanupPeriod/15) {
-				(*r.Log).Debugf("DHT: Old node seen %v ago. Deleting", time.Since(n.LastResponseTime))
-				r.Kill(n, p)
-				continue
-			}
-			if time.Since(n.LastResponseTime).Nanoseconds() < cleanupPeriod.Nanoseconds()/2 {
-				// Seen recently. Don't need to ping.
-				continue
-			}
-
-		} else {
-			// Not Reachable.
-			if len(n.PendingQueries) > util.MaxNodePendingQueries {
-				// DIDn't reply to 2 consecutive queries.
-				(*r.Log).Debugf("DHT: Node never replied to ping. Deleting. %v", n.Address)
-				r.Kill(n, p)
-				continue
-			}
-		}
-	PING:
-		needPing = append(needPing, n)
-	}
-	duration := time.Since(t0)
-	// If this pauses the server for too long I may have to segment the cleanup.
-	// 2000 nodes: it takes ~12ms
-	// 4000 nodes: ~24ms.
-	(*r.Log).Debugf("DHT: Routing table cleanup took %v\n", duration)
-	return needPing
-}
-
 // neighborhoodUpkeep will update the routingtable if the node n is closer than
 // the 8 nodes in our neighborhood, by replacing the least close one
 // (boundary). n.ID is assumed to have length 20.
-func (r *RoutingTable) NeighborhoodUpkeep(n *remoteNode.RemoteNode, proto string, p *peer.PeerStore) {
+func (r *RoutingTable) NeighborhoodUpkeep(n *remoteNode.RemoteNode, proto string, p peer.PeerStore) {
 	if r.BoundaryNode == nil {
 		r.AddNewNeighbor(n, false, proto, p)
 		return
@@ -267,14 +404,14 @@ func (r *RoutingTable) NeighborhoodUpkeep(n *remoteNode.RemoteNode, proto string
 	}
 }
 
-func (r *RoutingTable) AddNewNeighbor(n *remoteNode.RemoteNode, displaceBoundary bool, proto string, p *peer.PeerStore) {
+func (r *RoutingTable) AddNewNeighbor(n *remoteNode.RemoteNode, displaceBoundary bool, proto string, p peer.PeerStore) {
 	if err := r.Insert(n, proto); err != nil {
 		(*r.Log).Debugf("addNewNeighbor error: %v", err)
 		return
 	}
-	if displaceBoundary && r.BoundaryNode != nil {
+	if displaceBoundary && r.BoundaryNode != nil && !r.BoundaryNode.Honest {
 		// This will also take care of setting a new boundary.
-		r.Kill(r.BoundaryNode, p)
+		r.kill(r.BoundaryNode, p, ReasonDisplaced)
 	} else {
 		r.ResetNeighborhoodBoundary()
 	}
@@ -2,12 +2,15 @@ package routingTable
 
 import (
 	"crypto/rand"
+	"dht/logger"
+	"dht/peer"
 	"dht/remoteNode"
 	"dht/util"
 	"fmt"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 // 16 bytes.
@@ -175,3 +178,54 @@ func TestNodeDistance(t *testing.T) {
 //
 // #3 Suffix compression. Much less work (iterative version removed).
 // BenchmarkInsertRecursive	    5000	    448471 ns/op
+
+func TestCleanupKeepNodes(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	for _, keep := range []bool{false, true} {
+		r := NewRoutingTable(&log)
+		r.KeepNodes = keep
+		questionable, err := r.GetOrCreateNode("01abcdefghij01234567", "1.2.3.4:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		bad, err := r.GetOrCreateNode("02abcdefghij01234567", "1.2.3.5:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		for _, n := range []*remoteNode.RemoteNode{questionable, bad} {
+			n.Reachable = true
+			n.LastResponseTime = time.Now().Add(-time.Hour)
+		}
+		// The second node went bad.
+		for i := 0; i < remoteNode.MaxFailedQueries; i++ {
+			bad.PendingQueries[bad.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		}
+		r.ExpireQueries(time.Now(), nil)
+		questionable.PastQueries["1"] = &remoteNode.QueryType{Type: "ping"}
+		r.Cleanup(15*time.Minute, peer.NewMemoryPeerStore(0, 0))
+		if got := r.Length(); got != 1 {
+			t.Errorf("KeepNodes=%v: %d nodes left after cleanup, wanted 1", keep, got)
+		}
+		if _, ok := r.Addresses[bad.Address.String()]; ok {
+			t.Errorf("KeepNodes=%v: bad node not removed", keep)
+		}
+		if keep && len(questionable.PastQueries) != 0 {
+			t.Errorf("KeepNodes=%v: past queries not dropped", keep)
+		}
+	}
+}
+
+func TestLookupFilteredPrefersFastNodes(t *testing.T) {
+	var log logger.DebugLogger = &logger.NullLogger{}
+	r := NewRoutingTable(&log)
+	r.SetNodeID(randID(t))
+	target := randID(t)
+	slow, _ := r.GetOrCreateNode(randIDInRegion(t, target, 20), "1.2.3.4:1111", "udp4")
+	fast, _ := r.GetOrCreateNode(randIDInRegion(t, target, 20), "1.2.3.5:1111", "udp4")
+	far, _ := r.GetOrCreateNode(randIDInRegion(t, target, 5), "1.2.3.6:1111", "udp4")
+	slow.SRTT, fast.SRTT, far.SRTT = time.Second, 10*time.Millisecond, time.Millisecond
+	got := r.LookupFiltered(util.InfoHash(target))
+	if len(got) != 3 || got[0] != fast || got[1] != slow || got[2] != far {
+		t.Fatalf("LookupFiltered order is wrong")
+	}
+}
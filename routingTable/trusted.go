@@ -0,0 +1,102 @@
+package routingTable
+
+import (
+	"bytes"
+	"sort"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// Trusted nodes are the ones registered by the user, marked with
+// RemoteNode.Honest. They are pinned: cleanup pings them but never removes
+// them, and they are never evicted or displaced by other nodes, so only an
+// explicit Kill takes them out of the table. They are exempt from the
+// diversity limits, and lookups return them before untrusted nodes that are
+// about as close to the target.
+
+// SetTrusted marks n, which must be in the table, as trusted or not.
+func (r *RoutingTable) SetTrusted(n *remoteNode.RemoteNode, trusted bool) {
+	if n.Honest == trusted || r.Addresses[n.Address.String()] != n {
+		return
+	}
+	// Trusted nodes are not counted for the diversity limits.
+	r.countDiversity(n, -1)
+	n.Honest = trusted
+	r.countDiversity(n, 1)
+	if trusted {
+		r.addTrusted(n)
+		// It may have been left out of the index for lack of room.
+		if !remoteNode.BogusId(n.ID) {
+			if evicted, ok := r.nodeIndex.Add(n); ok && evicted != nil {
+				r.kill(evicted, nil, ReasonReplaced)
+			}
+		}
+	} else {
+		delete(r.trusted, n.Address.String())
+	}
+}
+
+// Trusted returns the trusted nodes, in no particular order.
+func (r *RoutingTable) Trusted() []*remoteNode.RemoteNode {
+	nodes := make([]*remoteNode.RemoteNode, 0, len(r.trusted))
+	for _, n := range r.trusted {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func (r *RoutingTable) addTrusted(n *remoteNode.RemoteNode) {
+	if r.trusted == nil {
+		r.trusted = make(map[string]*remoteNode.RemoteNode)
+	}
+	r.trusted[n.Address.String()] = n
+}
+
+// Lookup returns up to util.KNodes nodes closest to ID, trusted nodes first.
+func (r *RoutingTable) Lookup(ID util.InfoHash) []*remoteNode.RemoteNode {
+	return r.preferTrusted(ID, r.nodeIndex.Lookup(ID), false)
+}
+
+// preferTrusted adds to nodes the trusted ones that share at least as many
+// prefix bits with ID as the most distant of them, and moves the trusted
+// nodes first, closest first. The result is truncated to util.KNodes. If
+// filter is true, trusted nodes that shouldn't be queried about ID now are
+// not added.
+func (r *RoutingTable) preferTrusted(ID util.InfoHash, nodes []*remoteNode.RemoteNode, filter bool) []*remoteNode.RemoteNode {
+	if len(r.trusted) == 0 || len(ID) != 20 {
+		return nodes
+	}
+	minBits := 0
+	if len(nodes) >= util.KNodes {
+		minBits = CommonBits(nodes[len(nodes)-1].ID, string(ID))
+	}
+	for _, t := range r.trusted {
+		if len(t.ID) != len(ID) || filter && !isOK(t, ID) || CommonBits(t.ID, string(ID)) < minBits {
+			continue
+		}
+		found := false
+		for _, n := range nodes {
+			if n == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			nodes = append(nodes, t)
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].Honest != nodes[j].Honest {
+			return nodes[i].Honest
+		}
+		if nodes[i].Honest {
+			return bytes.Compare(xor(nodes[i].ID, string(ID)), xor(nodes[j].ID, string(ID))) < 0
+		}
+		return false
+	})
+	if len(nodes) > util.KNodes {
+		nodes = nodes[:util.KNodes]
+	}
+	return nodes
+}
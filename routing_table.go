@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"time"
+
+	"dht/peer"
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// RoutingTable is what the DHT needs from a routing table. It is implemented
+// by *routingTable.RoutingTable, with either of its node indexes (see
+// Config.RoutingTableType). Any implementation must pass the conformance
+// tests in routing_table_test.go.
+//
+// Like the rest of the DHT state, routing tables are owned by the DHT main
+// loop, and are not safe for concurrent use. Methods of DHT that are called
+// from other goroutines must access the table through DHT.do.
+type RoutingTable interface {
+	// HostPortToNode finds the node with the UDP address hostPort,
+	// resolving it with proto first. addr is the resolved address.
+	HostPortToNode(hostPort string, proto string) (node *remoteNode.RemoteNode, addr string, existed bool, err error)
+	// GetOrCreateNode returns the node with the UDP address hostPort,
+	// inserting a new one with ID if it's not in the table yet.
+	GetOrCreateNode(ID string, hostPort string, proto string) (*remoteNode.RemoteNode, error)
+	// Insert adds node to the table. Inserting a node whose address is
+	// already known is a no-op. Fails if the address is invalid or if there
+	// is no room for the node, in which case it may be kept as a
+	// replacement candidate.
+	Insert(node *remoteNode.RemoteNode, proto string) error
+	// Update sets the ID of a node that was inserted without one.
+	Update(node *remoteNode.RemoteNode, proto string) error
+	// Seen is called when node replied to one of our queries.
+	Seen(node *remoteNode.RemoteNode)
+	// Lookup returns up to util.KNodes nodes closest to ID, closest first,
+	// except that trusted nodes come before the others.
+	Lookup(ID util.InfoHash) []*remoteNode.RemoteNode
+	// LookupFiltered is like Lookup, but skips nodes that have too many
+	// pending queries or were recently asked about ID.
+	LookupFiltered(ID util.InfoHash) []*remoteNode.RemoteNode
+	// Kill removes n from the table, and marks it dead in p.
+	Kill(n *remoteNode.RemoteNode, p peer.PeerStore)
+	// Cleanup removes bad nodes and returns the ones that should be pinged,
+	// spread over cleanupPeriod, including replacement candidates.
+	Cleanup(cleanupPeriod time.Duration, p peer.PeerStore) (needPing []*remoteNode.RemoteNode)
+	// CleanupStep is like Cleanup, but returns after budget, with done
+	// false, if the sweep isn't finished. The next call continues it.
+	CleanupStep(budget, cleanupPeriod time.Duration, p peer.PeerStore) (needPing []*remoteNode.RemoteNode, done bool)
+	// NeighborhoodUpkeep inserts n if it's closer to our ID than the
+	// current neighborhood boundary.
+	NeighborhoodUpkeep(n *remoteNode.RemoteNode, proto string, p peer.PeerStore)
+	// Neighborhood returns the most distant node of our neighborhood, and
+	// how many prefix bits it shares with our ID.
+	Neighborhood() (boundary *remoteNode.RemoteNode, proximity int)
+	// SetNodeID changes our own ID.
+	SetNodeID(id string)
+	// Length is the number of nodes in the table, including those with
+	// unknown IDs.
+	Length() int
+	// Each calls f for each node in the table, in no particular order,
+	// until f returns false. f must not change the table.
+	Each(f func(n *remoteNode.RemoteNode) bool)
+	// ExpireQueries fails the queries to nodes in the table, and to
+	// replacement candidates, that got no reply within the node's timeout,
+	// and calls failed for each of them. It's the only place where
+	// failures are detected, so it must be called periodically.
+	ExpireQueries(now time.Time, failed func(n *remoteNode.RemoteNode, q *remoteNode.QueryType))
+	// AddReplacement keeps n, which is not in the table, as a candidate to
+	// replace a bad node in the same region of the table.
+	AddReplacement(n *remoteNode.RemoteNode)
+	// Replacement returns the replacement candidate with the host:port
+	// address addr, or nil.
+	Replacement(addr string) *remoteNode.RemoteNode
+	// Touch records a lookup of ID, which refreshes its region of the
+	// table.
+	Touch(ID string)
+	// RefreshTargets returns a random ID for each region of the table that
+	// wasn't looked up in the last period, and marks them refreshed.
+	RefreshTargets(period time.Duration) []string
+	// SetTrusted marks n, which must be in the table, as trusted or not.
+	// Trusted nodes are never removed except by Kill, and are preferred in
+	// lookups.
+	SetTrusted(n *remoteNode.RemoteNode, trusted bool)
+	// Trusted returns the trusted nodes.
+	Trusted() []*remoteNode.RemoteNode
+	// ReachableNodes exports the reachable nodes with known IDs, for
+	// persistence. The key is the "host:port" address, the value the ID.
+	ReachableNodes() map[string][]byte
+	// MemoryUsage estimates the memory used by the table, in bytes.
+	MemoryUsage() int64
+	// NodeMemoryUsage is like MemoryUsage without the queries of the
+	// nodes. It's kept up to date as nodes are added and removed.
+	NodeMemoryUsage() int64
+}
@@ -0,0 +1,442 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"dht/logger"
+	"dht/peer"
+	"dht/remoteNode"
+	"dht/routingTable"
+	"dht/util"
+)
+
+// Conformance tests for RoutingTable implementations.
+
+var routingTables = map[string]func(nodeID string) RoutingTable{
+	"tree": func(nodeID string) RoutingTable {
+		var log logger.DebugLogger = &logger.NullLogger{}
+		r := routingTable.NewRoutingTable(&log)
+		r.SetNodeID(nodeID)
+		return r
+	},
+	"kbucket": func(nodeID string) RoutingTable {
+		var log logger.DebugLogger = &logger.NullLogger{}
+		return routingTable.NewKBucketRoutingTable(nodeID, &log)
+	},
+}
+
+func TestRoutingTableConformance(t *testing.T) {
+	for name, newTable := range routingTables {
+		t.Run(name, func(t *testing.T) {
+			testRoutingTable(t, newTable)
+		})
+	}
+}
+
+func testRoutingTable(t *testing.T, newTable func(nodeID string) RoutingTable) {
+	t.Run("Insert", func(t *testing.T) {
+		r := newTable(id)
+		n, err := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		again, err := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		if err != nil || again != n {
+			t.Fatalf("GetOrCreateNode is not idempotent: %v, %v", again, err)
+		}
+		got, addr, existed, err := r.HostPortToNode("1.2.3.4:1111", "udp4")
+		if err != nil || !existed || got != n || addr != "1.2.3.4:1111" {
+			t.Fatalf("HostPortToNode = %v, %q, %v, %v", got, addr, existed, err)
+		}
+		if r.Length() != 1 {
+			t.Fatalf("Length = %d, wanted 1", r.Length())
+		}
+		if err := r.Insert(remoteNode.NewRemoteNode(randUDPAddrPort(0), "01abcdefghij01234569", nil), "udp4"); err == nil {
+			t.Fatalf("Insert accepted a node with port 0")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		r := newTable(id)
+		n, err := r.GetOrCreateNode("", "1.2.3.4:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		if got := r.Lookup(util.InfoHash(id)); len(got) != 0 {
+			t.Fatalf("node without ID returned by Lookup")
+		}
+		n.ID = "01abcdefghij01234568"
+		if err := r.Update(n, "udp4"); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if got := r.Lookup(util.InfoHash(id)); len(got) != 1 || got[0] != n {
+			t.Fatalf("Lookup after Update = %v", got)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		r := newTable(id)
+		var inserted []*remoteNode.RemoteNode
+		for i := 0; i < 100; i++ {
+			n := genremoteNode(randNodeID(t))
+			n.Reachable = true
+			if err := r.Insert(n, "udp4"); err == nil {
+				inserted = append(inserted, n)
+			}
+		}
+		if len(inserted) < util.KNodes {
+			t.Fatalf("only %d nodes inserted", len(inserted))
+		}
+		for _, target := range []string{id, randNodeID(t), randNodeID(t)} {
+			sort.Slice(inserted, func(i, j int) bool {
+				return bytes.Compare(
+					[]byte(util.HashDistance(util.InfoHash(inserted[i].ID), util.InfoHash(target))),
+					[]byte(util.HashDistance(util.InfoHash(inserted[j].ID), util.InfoHash(target)))) < 0
+			})
+			got := r.Lookup(util.InfoHash(target))
+			if len(got) != util.KNodes {
+				t.Fatalf("Lookup returned %d nodes, wanted %d", len(got), util.KNodes)
+			}
+			for i := range got {
+				if got[i] != inserted[i] {
+					t.Fatalf("Lookup(%x)[%d] = %x, wanted %x", target, i, got[i].ID, inserted[i].ID)
+				}
+			}
+		}
+	})
+
+	t.Run("LookupFiltered", func(t *testing.T) {
+		r := newTable(id)
+		busy, err := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		idle, err := r.GetOrCreateNode("01abcdefghij0123456a", "1.2.3.5:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		for i := 0; i <= util.MaxNodePendingQueries; i++ {
+			busy.NewQuery("ping")
+		}
+		if got := r.LookupFiltered(util.InfoHash(id)); len(got) != 1 || got[0] != idle {
+			t.Fatalf("LookupFiltered = %v, wanted only the idle node", got)
+		}
+		if got := r.Lookup(util.InfoHash(id)); len(got) != 2 {
+			t.Fatalf("Lookup = %v, wanted both nodes", got)
+		}
+	})
+
+	t.Run("Kill", func(t *testing.T) {
+		r := newTable(id)
+		n, err := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		if err != nil {
+			t.Fatalf("GetOrCreateNode: %v", err)
+		}
+		r.Kill(n, peer.NewMemoryPeerStore(1, 1))
+		if r.Length() != 0 {
+			t.Fatalf("Length after Kill = %d", r.Length())
+		}
+		if got := r.Lookup(util.InfoHash(id)); len(got) != 0 {
+			t.Fatalf("killed node returned by Lookup")
+		}
+		if _, _, existed, _ := r.HostPortToNode("1.2.3.4:1111", "udp4"); existed {
+			t.Fatalf("killed node returned by HostPortToNode")
+		}
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		r := newTable(id)
+		dead, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		for i := 0; i <= util.MaxNodePendingQueries; i++ {
+			dead.NewQuery("ping")
+		}
+		bad, _ := r.GetOrCreateNode("01abcdefghij01234569", "1.2.3.6:1111", "udp4")
+		bad.Reachable = true
+		bad.LastResponseTime = time.Now().Add(-time.Hour)
+		for i := 0; i < remoteNode.MaxFailedQueries; i++ {
+			bad.PendingQueries[bad.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		}
+		r.ExpireQueries(time.Now(), nil)
+		questionable, _ := r.GetOrCreateNode("01abcdefghij0123456b", "1.2.3.7:1111", "udp4")
+		questionable.Reachable = true
+		questionable.LastResponseTime = time.Now().Add(-time.Hour)
+		good, _ := r.GetOrCreateNode("01abcdefghij0123456a", "1.2.3.5:1111", "udp4")
+		good.Reachable = true
+		good.LastResponseTime = time.Now()
+		needPing := r.Cleanup(15*time.Minute, peer.NewMemoryPeerStore(1, 1))
+		if r.Length() != 2 {
+			t.Fatalf("Length after Cleanup = %d, wanted 2", r.Length())
+		}
+		if len(needPing) != 1 || needPing[0] != questionable {
+			t.Fatalf("Cleanup needPing = %v, wanted the questionable node", needPing)
+		}
+	})
+
+	t.Run("CleanupStep", func(t *testing.T) {
+		r := newTable(id)
+		var questionable []*remoteNode.RemoteNode
+		// No more than util.KNodes, so they fit in a single k-bucket.
+		for i := 0; i < util.KNodes-1; i++ {
+			n, _ := r.GetOrCreateNode(randNodeID(t), fmt.Sprintf("1.2.%d.4:1111", i), "udp4")
+			n.Reachable = true
+			n.LastResponseTime = time.Now().Add(-time.Hour)
+			questionable = append(questionable, n)
+		}
+		dead, _ := r.GetOrCreateNode(randNodeID(t), "1.2.3.5:1111", "udp4")
+		for i := 0; i <= util.MaxNodePendingQueries; i++ {
+			dead.NewQuery("ping")
+		}
+		// A tiny budget checks one node per step.
+		steps := 0
+		var needPing []*remoteNode.RemoteNode
+		for done := false; !done; steps++ {
+			if steps > util.KNodes {
+				t.Fatalf("CleanupStep didn't finish after %d steps", steps)
+			}
+			needPing, done = r.CleanupStep(time.Nanosecond, 15*time.Minute, peer.NewMemoryPeerStore(1, 1))
+			if !done && needPing != nil {
+				t.Fatalf("CleanupStep returned nodes to ping before the sweep was done")
+			}
+		}
+		if steps != util.KNodes {
+			t.Errorf("CleanupStep took %d steps, wanted %d", steps, util.KNodes)
+		}
+		if r.Length() != len(questionable) {
+			t.Errorf("Length after the sweep = %d, wanted %d", r.Length(), len(questionable))
+		}
+		if len(needPing) != len(questionable) {
+			t.Errorf("CleanupStep needPing has %d nodes, wanted %d", len(needPing), len(questionable))
+		}
+		// The next call starts a new sweep.
+		if needPing, done := r.CleanupStep(0, 15*time.Minute, peer.NewMemoryPeerStore(1, 1)); !done || len(needPing) != len(questionable) {
+			t.Errorf("second sweep: done %v, %d nodes to ping, wanted true and %d", done, len(needPing), len(questionable))
+		}
+	})
+
+	t.Run("Replacement", func(t *testing.T) {
+		r := newTable(id)
+		n, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		n.Reachable = true
+		n.LastResponseTime = time.Now().Add(-time.Hour)
+		for i := 0; i < remoteNode.MaxFailedQueries; i++ {
+			n.PendingQueries[n.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		}
+		r.ExpireQueries(time.Now(), nil)
+		addr, _ := net.ResolveUDPAddr("udp4", "1.2.3.5:1111")
+		c := remoteNode.NewRemoteNode(*addr, "01abcdefghij01234569", n.Log)
+		r.AddReplacement(c)
+		if r.Replacement("1.2.3.5:1111") != c {
+			t.Fatalf("candidate not found in the replacement cache")
+		}
+		// Unverified candidates are pinged.
+		needPing := r.Cleanup(15*time.Minute, peer.NewMemoryPeerStore(1, 1))
+		if len(needPing) != 1 || needPing[0] != c {
+			t.Fatalf("Cleanup needPing = %v, wanted the candidate", needPing)
+		}
+		if r.Length() != 0 {
+			t.Fatalf("bad node replaced by an unverified candidate")
+		}
+		n, _ = r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		n.Reachable = true
+		n.LastResponseTime = time.Now().Add(-time.Hour)
+		for i := 0; i < remoteNode.MaxFailedQueries; i++ {
+			n.PendingQueries[n.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		}
+		r.ExpireQueries(time.Now(), nil)
+		c.Reachable = true
+		c.LastResponseTime = time.Now()
+		r.Cleanup(15*time.Minute, peer.NewMemoryPeerStore(1, 1))
+		if got, _, existed, _ := r.HostPortToNode("1.2.3.5:1111", "udp4"); !existed || got != c {
+			t.Fatalf("bad node not replaced by the verified candidate")
+		}
+		if r.Length() != 1 || r.Replacement("1.2.3.5:1111") != nil {
+			t.Fatalf("candidate still in the replacement cache after promotion")
+		}
+	})
+
+	t.Run("Trusted", func(t *testing.T) {
+		r := newTable(id)
+		target := util.InfoHash(id)
+		near, _ := r.GetOrCreateNode(id[:19]+"\x00", "1.2.3.4:1111", "udp4")
+		near.Reachable = true
+		near.LastResponseTime = time.Now()
+		addr, _ := net.ResolveUDPAddr("udp4", "1.2.3.5:1111")
+		// Far from our ID, and bad.
+		far := remoteNode.NewRemoteNode(*addr, "\xff"+id[1:], near.Log)
+		far.Honest = true
+		if err := r.Insert(far, "udp4"); err != nil {
+			t.Fatalf("Insert: %v", err)
+		}
+		far.Reachable = true
+		far.LastResponseTime = time.Now().Add(-time.Hour)
+		for i := 0; i < remoteNode.MaxFailedQueries; i++ {
+			far.PendingQueries[far.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		}
+		r.ExpireQueries(time.Now(), nil)
+		if got := r.Lookup(target); len(got) != 2 || got[0] != far {
+			t.Fatalf("Lookup = %v, wanted the trusted node first", got)
+		}
+		needPing := r.Cleanup(15*time.Minute, peer.NewMemoryPeerStore(1, 1))
+		if len(needPing) != 1 || needPing[0] != far || r.Length() != 2 {
+			t.Fatalf("Cleanup removed the trusted node, or didn't ping it")
+		}
+		r.SetTrusted(near, true)
+		if got := r.Trusted(); len(got) != 2 {
+			t.Fatalf("Trusted returned %d nodes, wanted 2", len(got))
+		}
+		r.Kill(far, peer.NewMemoryPeerStore(1, 1))
+		r.SetTrusted(near, false)
+		if got := r.Trusted(); len(got) != 0 {
+			t.Fatalf("Trusted returned %d nodes, wanted 0", len(got))
+		}
+		if got := r.Lookup(target); len(got) != 1 || got[0] != near {
+			t.Fatalf("Lookup = %v, wanted only the untrusted node", got)
+		}
+	})
+
+	t.Run("Neighborhood", func(t *testing.T) {
+		r := newTable(id)
+		for _, v := range table[1:] {
+			n := genremoteNode(v.rid)
+			r.NeighborhoodUpkeep(n, "udp4", peer.NewMemoryPeerStore(1, 1))
+		}
+		boundary, proximity := r.Neighborhood()
+		if boundary == nil || proximity != 153 {
+			t.Fatalf("Neighborhood = %v, %d; wanted proximity 153", boundary, proximity)
+		}
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		r := newTable(id)
+		if got := r.RefreshTargets(0); len(got) == 0 {
+			t.Fatalf("no refresh targets with a zero period")
+		}
+		for _, target := range r.RefreshTargets(0) {
+			r.Touch(target)
+		}
+		if got := r.RefreshTargets(time.Hour); len(got) != 0 {
+			t.Fatalf("looked up regions still need a refresh: %d targets", len(got))
+		}
+	})
+
+	t.Run("Each", func(t *testing.T) {
+		r := newTable(id)
+		for i := 0; i < 5; i++ {
+			r.GetOrCreateNode("", fmt.Sprintf("1.2.3.%d:1111", i+1), "udp4")
+		}
+		count := 0
+		r.Each(func(n *remoteNode.RemoteNode) bool {
+			count++
+			return true
+		})
+		if count != 5 {
+			t.Fatalf("Each visited %d nodes, wanted 5", count)
+		}
+		count = 0
+		r.Each(func(n *remoteNode.RemoteNode) bool {
+			count++
+			return false
+		})
+		if count != 1 {
+			t.Fatalf("Each didn't stop when asked, visited %d nodes", count)
+		}
+	})
+
+	t.Run("ExpireQueries", func(t *testing.T) {
+		r := newTable(id)
+		n, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		n.PendingQueries[n.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		n.NewQuery("ping")
+		addr, _ := net.ResolveUDPAddr("udp4", "1.2.3.5:1111")
+		c := remoteNode.NewRemoteNode(*addr, "01abcdefghij01234569", n.Log)
+		c.PendingQueries[c.NewQuery("ping")].SentTime = time.Now().Add(-time.Minute)
+		r.AddReplacement(c)
+		failed := map[*remoteNode.RemoteNode]int{}
+		r.ExpireQueries(time.Now(), func(n *remoteNode.RemoteNode, q *remoteNode.QueryType) {
+			failed[n]++
+		})
+		if len(failed) != 2 || failed[n] != 1 || failed[c] != 1 {
+			t.Fatalf("ExpireQueries failed %v, wanted one query of the node and one of the candidate", failed)
+		}
+		// Queries are only failed once.
+		r.ExpireQueries(time.Now(), func(n *remoteNode.RemoteNode, q *remoteNode.QueryType) {
+			t.Errorf("query to %v failed again", n.Address.String())
+		})
+	})
+
+	t.Run("ReachableNodes", func(t *testing.T) {
+		r := newTable(id)
+		n, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		n.Reachable = true
+		r.GetOrCreateNode("01abcdefghij0123456a", "1.2.3.5:1111", "udp4")
+		got := r.ReachableNodes()
+		if len(got) != 1 || string(got["1.2.3.4:1111"]) != n.ID {
+			t.Fatalf("ReachableNodes = %v", got)
+		}
+	})
+
+	t.Run("MemoryUsage", func(t *testing.T) {
+		r := newTable(id)
+		empty := r.MemoryUsage()
+		n, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		one := r.MemoryUsage()
+		if one <= empty {
+			t.Fatalf("MemoryUsage didn't grow with a node: %d, then %d", empty, one)
+		}
+		n.NewQuery("ping")
+		if r.MemoryUsage() <= one {
+			t.Fatalf("MemoryUsage didn't grow with a pending query")
+		}
+	})
+
+	t.Run("NodeMemoryUsage", func(t *testing.T) {
+		r := newTable(id)
+		empty := r.NodeMemoryUsage()
+		n, _ := r.GetOrCreateNode("01abcdefghij01234568", "1.2.3.4:1111", "udp4")
+		one := r.NodeMemoryUsage()
+		if one <= empty {
+			t.Fatalf("NodeMemoryUsage didn't grow with a node: %d, then %d", empty, one)
+		}
+		n.NewQuery("ping")
+		if r.NodeMemoryUsage() != one || r.MemoryUsage() <= one {
+			t.Fatalf("NodeMemoryUsage %d, MemoryUsage %d with a pending query, wanted %d and more", r.NodeMemoryUsage(), r.MemoryUsage(), one)
+		}
+		c := remoteNode.NewRemoteNode(net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 1111}, "01abcdefghij01234569", n.Log)
+		r.AddReplacement(c)
+		if r.NodeMemoryUsage() <= one {
+			t.Fatalf("NodeMemoryUsage didn't grow with a replacement candidate")
+		}
+		// The verified candidate takes the place of the killed node.
+		c.Reachable = true
+		r.Kill(n, nil)
+		if r.Replacement("1.2.3.5:1111") != nil || r.Length() != 1 {
+			t.Fatalf("candidate not promoted")
+		}
+		if got := r.NodeMemoryUsage(); got != one {
+			t.Fatalf("NodeMemoryUsage = %d after the replacement, wanted %d", got, one)
+		}
+		r.Kill(c, nil)
+		if got := r.NodeMemoryUsage(); got != empty {
+			t.Fatalf("NodeMemoryUsage = %d after removing the nodes, wanted %d", got, empty)
+		}
+	})
+}
+
+func randNodeID(t *testing.T) string {
+	b, err := remoteNode.RandNodeId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func randUDPAddrPort(port int) net.UDPAddr {
+	a := randUDPAddr()
+	a.Port = port
+	return a
+}
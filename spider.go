@@ -0,0 +1,231 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"dht/remoteNode"
+	"dht/util"
+)
+
+// Spider mode. A node with Config.SpiderSink set records every get_peers and
+// announce_peer query it receives, which is useful to harvest infohashes for
+// analytics. To see more of the keyspace, the node can periodically pick a new
+// random node ID (Config.SpiderIDRotatePeriod), and reply to queries with an ID
+// that is very close to the target (Config.SpiderNeighborIDs), which makes the
+// querying node more likely to announce to us.
+
+// InfoHashEvent is a get_peers or announce_peer query seen by a spider.
+type InfoHashEvent struct {
+	// Query type: "get_peers" or "announce_peer".
+	Type     string
+	InfoHash util.InfoHash
+	// Node ID of the source node.
+	NodeID string
+	// UDP address of the source node.
+	Addr net.UDPAddr
+	// Announced port. announce_peer only.
+	Port int
+	// Whether the announce token was valid. announce_peer only.
+	ValidToken bool
+	Time       time.Time
+}
+
+// MarshalJSON encodes binary fields in hex and the address as host:port.
+func (e InfoHashEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string    `json:"type"`
+		InfoHash   string    `json:"info_hash"`
+		NodeID     string    `json:"node_id"`
+		Addr       string    `json:"addr"`
+		Port       int       `json:"port,omitempty"`
+		ValidToken bool      `json:"valid_token,omitempty"`
+		Time       time.Time `json:"time"`
+	}{e.Type, e.InfoHash.String(), fmt.Sprintf("%x", e.NodeID), e.Addr.String(), e.Port, e.ValidToken, e.Time})
+}
+
+// InfoHashSink receives the events recorded in spider mode. Record is called
+// from the DHT main loop, so it should not block for long.
+type InfoHashSink interface {
+	Record(e InfoHashEvent) error
+}
+
+// SinkFunc adapts a function to the InfoHashSink interface.
+type SinkFunc func(e InfoHashEvent)
+
+func (f SinkFunc) Record(e InfoHashEvent) error {
+	f(e)
+	return nil
+}
+
+// JSONLSink writes each event as a line of JSON. It is safe for concurrent use.
+type JSONLSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{enc: json.NewEncoder(w)}
+}
+
+func (s *JSONLSink) Record(e InfoHashEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(e)
+}
+
+// RotatingFileSink writes events as JSON lines to a file, which is rotated
+// when it grows beyond maxBytes. Rotated files get the suffixes .1 (newest)
+// to .maxFiles (oldest). If a rotation fails, Record still writes the event to
+// the current file and returns the error. It is safe for concurrent use.
+type RotatingFileSink struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func NewRotatingFileSink(path string, maxBytes int64, maxFiles int) (*RotatingFileSink, error) {
+	s := &RotatingFileSink{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RotatingFileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, st.Size()
+	return nil
+}
+
+// rotate moves the current file out of the way and opens a new one. If that
+// fails, it reopens the current file, so events are still written, and
+// returns the error. s.f is nil only if no file could be opened.
+func (s *RotatingFileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	err := s.shift()
+	if oerr := s.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+// shift renames the rotated files and the current one to the next suffix,
+// dropping the oldest.
+func (s *RotatingFileSink) shift() error {
+	for i := s.maxFiles - 1; i > 0; i-- {
+		// Missing files are normal until maxFiles rotations happened.
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("RotatingFileSink: %w", err)
+		}
+	}
+	var err error
+	if s.maxFiles > 0 {
+		err = os.Rename(s.path, s.path+".1")
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("RotatingFileSink: %w", err)
+	}
+	return nil
+}
+
+func (s *RotatingFileSink) Record(e InfoHashEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return fmt.Errorf("RotatingFileSink: closed")
+	}
+	var rotateErr error
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxBytes {
+		if rotateErr = s.rotate(); s.f == nil {
+			return rotateErr
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// The event was written to the current file, rotation is retried with
+	// the next one.
+	return rotateErr
+}
+
+// Close closes the current file.
+func (s *RotatingFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (d *DHT) recordInfoHash(e InfoHashEvent) {
+	if d.config.SpiderSink == nil {
+		return
+	}
+	totalSpiderEvents.Add(1)
+	if err := d.config.SpiderSink.Record(e); err != nil {
+		d.DebugLogger.Errorf("DHT: spider sink error: %v", err)
+	}
+}
+
+// replyID returns the node ID used in replies to a query about target. In
+// spider mode with SpiderNeighborIDs, it's an ID that only differs from
+// target in the last bytes.
+func (d *DHT) replyID(target string) string {
+	if !d.config.SpiderNeighborIDs || len(target) != 20 {
+		return d.nodeId
+	}
+	return neighborID(target, d.nodeId)
+}
+
+// neighborID returns an ID with the first 15 bytes of target and the rest of
+// id.
+func neighborID(target, id string) string {
+	return target[:15] + id[15:]
+}
+
+// rotateNodeID switches to a new random node ID and starts building a
+// neighborhood around it. The new ID is not persisted.
+func (d *DHT) rotateNodeID() {
+	b, err := remoteNode.RandNodeId()
+	if err != nil {
+		d.DebugLogger.Errorf("DHT: failed to rotate node ID: %v", err)
+		return
+	}
+	id := string(b)
+	d.DebugLogger.Infof("DHT: rotating node ID %x => %x", d.nodeId, id)
+	d.nodeId = id
+	d.routingTable.SetNodeID(id)
+	d.findNode(id)
+}
@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEvent() InfoHashEvent {
+	return InfoHashEvent{
+		Type:     "announce_peer",
+		InfoHash: testInfoHash,
+		NodeID:   id,
+		Addr:     net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1111},
+		Port:     6881,
+		Time:     time.Unix(1000, 0).UTC(),
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	var b bytes.Buffer
+	s := NewJSONLSink(&b)
+	if err := s.Record(testEvent()); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", b.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"type":      "announce_peer",
+		"info_hash": "d1c5676ae7ac98e8b19f63565905105e3c4c37a2",
+		"addr":      "1.2.3.4:1111",
+		"port":      6881.0,
+	} {
+		if got[k] != want {
+			t.Errorf("%v = %v, wanted %v", k, got[k], want)
+		}
+	}
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "spider.jsonl")
+	line, _ := json.Marshal(testEvent())
+	// Room for two events per file.
+	s, err := NewRotatingFileSink(p, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFileSink: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 7; i++ {
+		if err := s.Record(testEvent()); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	for _, f := range []string{p, p + ".1", p + ".2"} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("Stat(%v): %v", f, err)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); err == nil {
+		t.Errorf("%v.3 exists, wanted at most 2 rotated files", p)
+	}
+}
+
+func TestRotatingFileSinkRenameError(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "spider.jsonl")
+	// A non-empty directory in the way of the rotated file.
+	if err := os.MkdirAll(filepath.Join(p+".1", "x"), 0750); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	line, _ := json.Marshal(testEvent())
+	s, err := NewRotatingFileSink(p, int64(len(line)+1), 1)
+	if err != nil {
+		t.Fatalf("NewRotatingFileSink: %v", err)
+	}
+	defer s.Close()
+	if err := s.Record(testEvent()); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if err := s.Record(testEvent()); err == nil {
+		t.Errorf("Record didn't report the failed rotation")
+	}
+	// Both events are in the current file.
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if got, want := len(b), 2*(len(line)+1); got != want {
+		t.Errorf("%v has %d bytes, wanted %d", p, got, want)
+	}
+}
+
+func TestNeighborID(t *testing.T) {
+	target := "01abcdefghij01234567"
+	n := neighborID(target, "zzzzzzzzzzzzzzzzzzzz")
+	if len(n) != 20 {
+		t.Fatalf("neighborID len = %d, wanted 20", len(n))
+	}
+	if n[:15] != target[:15] || n[15:] != "zzzzz" {
+		t.Fatalf("neighborID = %q", n)
+	}
+}
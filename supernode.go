@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"time"
+
+	"dht/remoteNode"
+)
+
+// NewSupernodeConfig creates a *Config for a supernode: a high-capacity
+// bootstrap or router node that doesn't download torrents. Compared to
+// NewConfig, it allows a much larger routing table and peer store, processes
+// more packets and never announces. The routing table is the default tree,
+// bounded only by MaxNodes; set MemoryBudget to bound its memory too.
+func NewSupernodeConfig() *Config {
+	c := NewConfig()
+	c.Supernode = true
+	c.MaxNodes = 20000
+	c.MaxInfoHashes = 65536
+	c.MaxInfoHashPeers = 512
+	c.RateLimit = 2000
+	c.ThrottlerTrackedClients = 20000
+	c.CleanupPeriod = 30 * time.Minute
+	return c
+}
+
+// crawl looks up a random ID to discover new nodes, unless the routing table
+// is already full.
+func (d *DHT) crawl() {
+	if !d.roomForNodes() {
+		return
+	}
+	id, err := remoteNode.RandNodeId()
+	if err != nil {
+		d.DebugLogger.Errorf("DHT: crawl failed to generate a random ID: %v", err)
+		return
+	}
+	totalCrawls.Add(1)
+	d.findNode(string(id))
+}
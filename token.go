@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"sync"
+
+	"dht/util"
+)
+
+// TokenManager issues the tokens handed out in get_peers replies and verifies
+// the ones sent back in announce_peer queries. A custom implementation can be
+// set in Config.TokenManager, for example to share secrets between the nodes
+// of a cluster.
+type TokenManager interface {
+	// Token returns the token for the node at addr asking about ih.
+	Token(addr net.UDPAddr, ih util.InfoHash) string
+	// Check reports whether token was issued to addr for ih and has not
+	// expired yet.
+	Check(addr net.UDPAddr, ih util.InfoHash, token string) bool
+	// Rotate is called every Config.TokenRotatePeriod. Tokens issued
+	// before the previous rotation should stop being accepted.
+	Rotate()
+}
+
+// tokenLen is the length in bytes of the tokens issued by HMACTokenManager.
+const tokenLen = 8
+
+// HMACTokenManager is the default TokenManager. Tokens are an HMAC-SHA256 of
+// the node's IP address, and optionally of the infohash, keyed with a random
+// secret. The port is not covered, so NATed nodes that change their source
+// port can still announce. Tokens from the current and the previous secret
+// are accepted. It is safe for concurrent use.
+type HMACTokenManager struct {
+	secretLength int
+	bindInfoHash bool
+
+	mu sync.Mutex
+	// Current secret first.
+	secrets [][]byte
+}
+
+// NewHMACTokenManager creates a token manager using random secrets of
+// secretLength bytes, or 20 if secretLength is not positive. If bindInfoHash
+// is true, tokens are only valid for the infohash that was asked for.
+func NewHMACTokenManager(secretLength int, bindInfoHash bool) *HMACTokenManager {
+	if secretLength <= 0 {
+		secretLength = 20
+	}
+	m := &HMACTokenManager{secretLength: secretLength, bindInfoHash: bindInfoHash}
+	m.secrets = [][]byte{m.newSecret(), m.newSecret()}
+	return m
+}
+
+func (m *HMACTokenManager) newSecret() []byte {
+	b := make([]byte, m.secretLength)
+	// Tokens derived from a predictable secret could be forged, and there's
+	// no way to recover from a broken system random source.
+	if _, err := rand.Read(b); err != nil {
+		panic("dht: reading token secret: " + err.Error())
+	}
+	return b
+}
+
+// Secrets returns the current and previous secrets.
+func (m *HMACTokenManager) Secrets() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.secrets...)
+}
+
+// SetSecrets replaces the secrets used to issue and check tokens. The first
+// one is used to issue tokens, all of them are accepted when checking.
+func (m *HMACTokenManager) SetSecrets(secrets [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets = append([][]byte(nil), secrets...)
+}
+
+func (m *HMACTokenManager) Rotate() {
+	s := m.newSecret()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.secrets) == 0 {
+		m.secrets = [][]byte{s}
+		return
+	}
+	m.secrets = [][]byte{s, m.secrets[0]}
+}
+
+func (m *HMACTokenManager) Token(addr net.UDPAddr, ih util.InfoHash) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.secrets) == 0 {
+		return ""
+	}
+	return m.token(m.secrets[0], addr.IP, ih)
+}
+
+func (m *HMACTokenManager) Check(addr net.UDPAddr, ih util.InfoHash, token string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, secret := range m.secrets {
+		if hmac.Equal([]byte(m.token(secret, addr.IP, ih)), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *HMACTokenManager) token(secret []byte, ip net.IP, ih util.InfoHash) string {
+	h := hmac.New(sha256.New, secret)
+	// Use the 16-byte form so IPv4 and IPv4-mapped IPv6 addresses match.
+	h.Write(ip.To16())
+	if m.bindInfoHash {
+		h.Write([]byte(ih))
+	}
+	return string(h.Sum(nil)[:tokenLen])
+}
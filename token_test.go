@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"dht/util"
+)
+
+func TestHMACTokenManager(t *testing.T) {
+	ih := util.InfoHash("01abcdefghij01234567")
+	other := util.InfoHash("01abcdefghij01234568")
+	addr := net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1111}
+	natAddr := net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 2222}
+	otherAddr := net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 1111}
+
+	m := NewHMACTokenManager(20, false)
+	token := m.Token(addr, ih)
+	if !m.Check(addr, ih, token) {
+		t.Fatalf("token rejected for the same address")
+	}
+	if !m.Check(natAddr, ih, token) {
+		t.Fatalf("token rejected after the source port changed")
+	}
+	if !m.Check(addr, other, token) {
+		t.Fatalf("token rejected for another infohash without infohash binding")
+	}
+	if m.Check(otherAddr, ih, token) {
+		t.Fatalf("token accepted for another IP")
+	}
+	m.Rotate()
+	if !m.Check(addr, ih, token) {
+		t.Fatalf("token rejected after one rotation")
+	}
+	m.Rotate()
+	if m.Check(addr, ih, token) {
+		t.Fatalf("token accepted after two rotations")
+	}
+
+	bound := NewHMACTokenManager(20, true)
+	token = bound.Token(addr, ih)
+	if !bound.Check(addr, ih, token) {
+		t.Fatalf("bound token rejected for its infohash")
+	}
+	if bound.Check(addr, other, token) {
+		t.Fatalf("bound token accepted for another infohash")
+	}
+
+	// Nodes sharing secrets accept each other's tokens.
+	shared := NewHMACTokenManager(20, false)
+	shared.SetSecrets(m.Secrets())
+	if !shared.Check(addr, ih, m.Token(addr, ih)) {
+		t.Fatalf("token rejected by a manager with the same secrets")
+	}
+
+	// Rotating without secrets starts over with a fresh one.
+	shared.SetSecrets(nil)
+	shared.Rotate()
+	if !shared.Check(addr, ih, shared.Token(addr, ih)) {
+		t.Fatalf("token rejected after rotating without secrets")
+	}
+}
@@ -1,107 +1,260 @@
 package util
 
 import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
-	"vitess.io/vitess/go/cache"
+	"github.com/golang/groupcache/lru"
 )
 
-// NewThrottle creates a new client throttler that blocks spammy clients.
+// ThrottleConfig holds the limits used by a ClientThrottle.
+type ThrottleConfig struct {
+	// MaxPerMinute is the number of packets a single host may send per minute
+	// before being blocked.
+	MaxPerMinute int
+	// MaxSubnetPerMinute is the number of packets all hosts in the same /24
+	// (IPv4) or /64 (IPv6) subnet may send per minute. Zero disables subnet
+	// limits.
+	MaxSubnetPerMinute int
+	// MaxHosts is the number of hosts and subnets the throttle remembers.
+	// The least recently seen ones are forgotten first.
+	MaxHosts int64
+	// BlockDuration is how long a host or subnet stays blocked after
+	// exceeding its limit. Default value: 10 minutes.
+	BlockDuration time.Duration
+	// Allowlist contains IPs or CIDRs that are never throttled.
+	Allowlist []string
+}
+
+// NewThrottler creates a new client throttler that blocks spammy clients.
 // UPDATED in 2015-01-17: clients now have to specify the limits. Use 10 and
 // 1000 if you want to use the old default values.
 //
 // UPDATED in 2023-03-12: Use the latest vitess LRUCache implementation
+//
+// UPDATED in 2026-10-18: Token buckets with lazy refill. Use
+// NewThrottlerWithConfig for subnet limits, block durations and allowlists.
 func NewThrottler(maxPerMinute int, maxHosts int64) *ClientThrottle {
-	r := ClientThrottle{
-		maxPerMinute: maxPerMinute,
-		c: cache.NewLRUCache(maxHosts, func(a any) int64 {
-			return a.(hits).Size()
-		}),
-		blocked: cache.NewLRUCache(maxHosts, func(a any) int64 {
-			return a.(hits).Size()
-		}),
-		stop: make(chan bool),
-	}
-	go r.cleanup()
-	return &r
+	r, _ := NewThrottlerWithConfig(ThrottleConfig{
+		MaxPerMinute: maxPerMinute,
+		MaxHosts:     maxHosts,
+	})
+	return r
+}
+
+// NewThrottlerWithConfig creates a client throttler using the limits in cfg.
+// It fails if an allowlist entry is neither an IP nor a CIDR.
+func NewThrottlerWithConfig(cfg ThrottleConfig) (*ClientThrottle, error) {
+	if cfg.BlockDuration <= 0 {
+		cfg.BlockDuration = 10 * time.Minute
+	}
+	if cfg.MaxHosts <= 0 {
+		cfg.MaxHosts = 1000
+	}
+	r := &ClientThrottle{
+		cfg:     cfg,
+		hosts:   lru.New(int(cfg.MaxHosts)),
+		subnets: lru.New(int(cfg.MaxHosts)),
+		blocked: make(map[string]time.Time),
+		now:     time.Now,
+	}
+	for _, a := range cfg.Allowlist {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("throttle allowlist: invalid IP %q", a)
+			}
+			if ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("throttle allowlist: %v", err)
+		}
+		r.allow = append(r.allow, n)
+	}
+	return r, nil
 }
 
-// ClientThrottle identifies and blocks hosts that are too spammy. It only
-// cares about the number of operations per minute.
+// ClientThrottle identifies and blocks hosts that are too spammy. Each host
+// and each subnet has a token bucket that refills continuously at the
+// configured per-minute rate. Buckets are only refilled when the host is seen
+// again, so the cost of a check is O(1) regardless of the number of tracked
+// hosts. It is safe for concurrent use.
 type ClientThrottle struct {
-	maxPerMinute int
+	cfg   ThrottleConfig
+	allow []*net.IPNet
 
-	// Rate limiter.
-	c *cache.LRUCache
+	mu sync.Mutex
+	// Rate limiters, keyed by host and by subnet.
+	hosts   *lru.Cache
+	subnets *lru.Cache
+	// Blocked hosts and subnets, with the time they get unblocked.
+	blocked map[string]time.Time
 
-	// Hosts that get blocked once go to a separate cache, and stay forever
-	// until they stop hitting us enough to fall off the blocked cache.
-	blocked *cache.LRUCache
+	now func() time.Time
+}
 
-	// This channel will be closed when the ClientThrottle should be stopped.
-	stop chan bool
+// bucket is a token bucket. tokens is the amount available at time last.
+type bucket struct {
+	tokens float64
+	last   time.Time
 }
 
-// Stops the ClientThrottle and all internal goroutines.
-func (r *ClientThrottle) Stop() {
-	close(r.stop)
+// take refills the bucket for the time elapsed since it was last used and
+// consumes one token. Returns false if the bucket is empty.
+func (b *bucket) take(now time.Time, perMinute int) bool {
+	capacity := float64(perMinute)
+	b.tokens += now.Sub(b.last).Minutes() * capacity
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
 
+// Stop is kept for compatibility. The throttle no longer runs background
+// goroutines, so there is nothing to stop.
+func (r *ClientThrottle) Stop() {
 }
 
+// CheckBlock returns false if packets from host should be dropped, either
+// because host or its subnet was blocked or because this packet exceeds
+// their limits.
 func (r *ClientThrottle) CheckBlock(host string) bool {
-	_, blocked := r.blocked.Get(host)
-	if blocked {
+	ip := net.ParseIP(host)
+	if r.allowed(ip) {
+		return true
+	}
+	subnet := Subnet(ip)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if r.isBlocked(host, now) || (subnet != "" && r.isBlocked(subnet, now)) {
 		// Bad guy stays there.
 		return false
 	}
+	if !r.take(r.hosts, host, now, r.cfg.MaxPerMinute) {
+		// New bad guy.
+		r.block(host, now)
+		return false
+	}
+	if subnet != "" && r.cfg.MaxSubnetPerMinute > 0 {
+		if !r.take(r.subnets, subnet, now, r.cfg.MaxSubnetPerMinute) {
+			r.block(subnet, now)
+			return false
+		}
+	}
+	return true
+}
+
+// Blocked returns the hosts and subnets currently blocked, with the time at
+// which each of them will be unblocked.
+func (r *ClientThrottle) Blocked() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	ret := make(map[string]time.Time, len(r.blocked))
+	for k, until := range r.blocked {
+		if now.After(until) {
+			delete(r.blocked, k)
+			continue
+		}
+		ret[k] = until
+	}
+	return ret
+}
+
+// Unblock removes host, which can be an IP or a subnet as returned by
+// Blocked, from the blocked list and resets its rate limiter. Returns false
+// if it was not blocked.
+func (r *ClientThrottle) Unblock(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.blocked[host]
+	delete(r.blocked, host)
+	r.hosts.Remove(host)
+	r.subnets.Remove(host)
+	return ok
+}
+
+func (r *ClientThrottle) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	v, ok := r.c.Get(host)
-	var h hits
+func (r *ClientThrottle) take(c *lru.Cache, key string, now time.Time, perMinute int) bool {
+	v, ok := c.Get(key)
 	if !ok {
-		h = hits(59)
-	} else {
-		h = v.(hits) - 1
+		// New hosts start with a full bucket.
+		v = &bucket{tokens: float64(perMinute), last: now}
+		c.Add(key, v)
 	}
-	if int(h) < 60-r.maxPerMinute {
-		// fmt.Printf("blocking because int(h)=%v < 60-r.maxPerMinute = (60-%v) => %v\n", int(h), r.maxPerMinute, 60-r.maxPerMinute)
-		r.c.Set(host, h-300)
-		// New bad guy.
-		r.blocked.Set(host, h) // The value here is not relevant.
+	return v.(*bucket).take(now, perMinute)
+}
+
+func (r *ClientThrottle) isBlocked(key string, now time.Time) bool {
+	until, ok := r.blocked[key]
+	if !ok {
+		return false
+	}
+	if now.After(until) {
+		delete(r.blocked, key)
+		// Give it a fresh start.
+		r.hosts.Remove(key)
+		r.subnets.Remove(key)
 		return false
 	}
-	r.c.Set(host, h)
 	return true
 }
 
-// refill the buckets.
-// this is the first way I thought of how to implement client rate limiting.
-// Need to think and research more.
-func (r *ClientThrottle) cleanup() {
-	// Check the bucket faster than the rate period, to reduce the pressure in the cache.
-	t := time.Tick(5 * time.Second)
-
-	for {
-		select {
-		case <-t:
-			var h hits
-			// This is ridiculously inefficient but it'll have to do for now.
-			for _, item := range r.c.Items() {
-				h = item.Value.(hits) + 5
-				if h > 60 {
-					// Reduce pressure in the LRU.
-					r.c.Delete(item.Key)
-				} else {
-					r.c.Set(item.Key, h)
-				}
+func (r *ClientThrottle) block(key string, now time.Time) {
+	if int64(len(r.blocked)) >= r.cfg.MaxHosts {
+		// Make room by forgetting the entry that would be unblocked first.
+		var oldest string
+		var oldestUntil time.Time
+		for k, until := range r.blocked {
+			if oldest == "" || until.Before(oldestUntil) {
+				oldest, oldestUntil = k, until
 			}
-		case <-r.stop:
-			return
 		}
+		delete(r.blocked, oldest)
 	}
+	r.blocked[key] = now.Add(r.cfg.BlockDuration)
 }
 
-type hits int
-
-func (h hits) Size() int64 {
-	return 1
+// Subnet returns the /24 (IPv4) or /64 (IPv6) subnet of ip in CIDR notation,
+// or an empty string if ip is nil.
+func Subnet(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		n := net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		return n.String()
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return n.String()
 }
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestThrottle(t *testing.T, cfg ThrottleConfig) (*ClientThrottle, *time.Time) {
+	r, err := NewThrottlerWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewThrottlerWithConfig: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestThrottleRefill(t *testing.T) {
+	r, now := newTestThrottle(t, ThrottleConfig{MaxPerMinute: 10, MaxHosts: 10, BlockDuration: time.Minute})
+
+	for i := 0; i < 10; i++ {
+		if !r.CheckBlock("1.2.3.4") {
+			t.Fatalf("packet %d blocked, wanted allowed", i)
+		}
+	}
+	// Half the bucket refills after 30 seconds, but the host exceeded its
+	// limit and stays blocked until BlockDuration passes.
+	if r.CheckBlock("1.2.3.4") {
+		t.Fatalf("11th packet allowed, wanted blocked")
+	}
+	*now = now.Add(30 * time.Second)
+	if r.CheckBlock("1.2.3.4") {
+		t.Fatalf("blocked host allowed before BlockDuration")
+	}
+	if _, ok := r.Blocked()["1.2.3.4"]; !ok {
+		t.Fatalf("Blocked() = %v, wanted 1.2.3.4", r.Blocked())
+	}
+	*now = now.Add(31 * time.Second)
+	if !r.CheckBlock("1.2.3.4") {
+		t.Fatalf("host still blocked after BlockDuration")
+	}
+	if len(r.Blocked()) != 0 {
+		t.Fatalf("Blocked() = %v, wanted empty", r.Blocked())
+	}
+	// Other hosts are not affected.
+	if !r.CheckBlock("1.2.4.4") {
+		t.Fatalf("unrelated host blocked")
+	}
+}
+
+func TestThrottleSubnet(t *testing.T) {
+	r, _ := newTestThrottle(t, ThrottleConfig{MaxPerMinute: 10, MaxSubnetPerMinute: 15, MaxHosts: 10})
+
+	for i := 0; i < 10; i++ {
+		r.CheckBlock("10.0.0.1")
+	}
+	for i := 0; i < 5; i++ {
+		if !r.CheckBlock("10.0.0.2") {
+			t.Fatalf("packet %d from 10.0.0.2 blocked, wanted allowed", i)
+		}
+	}
+	if r.CheckBlock("10.0.0.3") {
+		t.Fatalf("subnet limit not enforced")
+	}
+	if _, ok := r.Blocked()["10.0.0.0/24"]; !ok {
+		t.Fatalf("Blocked() = %v, wanted 10.0.0.0/24", r.Blocked())
+	}
+	if !r.Unblock("10.0.0.0/24") {
+		t.Fatalf("Unblock(10.0.0.0/24) = false, wanted true")
+	}
+	if !r.CheckBlock("10.0.0.3") {
+		t.Fatalf("subnet still blocked after Unblock")
+	}
+	if !r.CheckBlock("10.0.1.1") {
+		t.Fatalf("host in another subnet blocked")
+	}
+}
+
+func TestThrottleAllowlist(t *testing.T) {
+	r, _ := newTestThrottle(t, ThrottleConfig{MaxPerMinute: 1, MaxHosts: 10, Allowlist: []string{"192.168.0.0/16", "::1"}})
+	for i := 0; i < 10; i++ {
+		if !r.CheckBlock("192.168.1.1") || !r.CheckBlock("::1") {
+			t.Fatalf("allowlisted host blocked")
+		}
+	}
+	if _, err := NewThrottlerWithConfig(ThrottleConfig{Allowlist: []string{"bogus"}}); err == nil {
+		t.Fatalf("invalid allowlist entry accepted")
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	for ip, want := range map[string]string{
+		"1.2.3.4":              "1.2.3.0/24",
+		"2001:db8:1:2:3::4":    "2001:db8:1:2::/64",
+		"::ffff:10.20.30.40":   "10.20.30.0/24",
+		"2001:db8:1:2:ffff::1": "2001:db8:1:2::/64",
+	} {
+		if got := Subnet(net.ParseIP(ip)); got != want {
+			t.Errorf("Subnet(%v) = %v, wanted %v", ip, got, want)
+		}
+	}
+}